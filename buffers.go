@@ -0,0 +1,64 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"reflect"
+
+	intref "github.com/igolaizola/resumetls/internal/reflect"
+)
+
+// buffers contains data received by a tls conn that hasn't been delivered yet
+type buffers struct {
+	// rawInput is received ciphertext that hasn't been decrypted
+	rawInput []byte
+	// input is decrypted application data that hasn't been read
+	input []byte
+	// hand is decrypted post-handshake data that hasn't been processed
+	hand []byte
+}
+
+// getBuffers obtains a copy of the pending input buffers of a tls conn
+func getBuffers(conn *tls.Conn) buffers {
+	r := reflect.ValueOf(conn).Elem()
+	rawInput := (*bytes.Buffer)(intref.FieldPointer(r, "rawInput"))
+	hand := (*bytes.Buffer)(intref.FieldPointer(r, "hand"))
+
+	// Read the remaining input from a copy of the reader
+	input := *(*bytes.Reader)(intref.FieldPointer(r, "input"))
+	plaintext, _ := io.ReadAll(&input)
+
+	return buffers{
+		rawInput: cloneBytes(rawInput.Bytes()),
+		input:    plaintext,
+		hand:     cloneBytes(hand.Bytes()),
+	}
+}
+
+// equal returns whether both buffers hold the same data
+func (b buffers) equal(other buffers) bool {
+	return bytes.Equal(b.rawInput, other.rawInput) && bytes.Equal(b.input, other.input) &&
+		bytes.Equal(b.hand, other.hand)
+}
+
+// setBuffers sets the pending input buffers of a tls conn, they are delivered
+// before reading from the network
+func setBuffers(conn *tls.Conn, b buffers) {
+	r := reflect.ValueOf(conn).Elem()
+	rawInput := (*bytes.Buffer)(intref.FieldPointer(r, "rawInput"))
+	rawInput.Reset()
+	rawInput.Write(b.rawInput)
+	hand := (*bytes.Buffer)(intref.FieldPointer(r, "hand"))
+	hand.Reset()
+	hand.Write(b.hand)
+	input := (*bytes.Reader)(intref.FieldPointer(r, "input"))
+	input.Reset(cloneBytes(b.input))
+}
+
+// rawInputLen returns the length of the received ciphertext that hasn't been
+// decrypted
+func rawInputLen(conn *tls.Conn) int {
+	r := reflect.ValueOf(conn).Elem()
+	return (*bytes.Buffer)(intref.FieldPointer(r, "rawInput")).Len()
+}
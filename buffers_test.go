@@ -0,0 +1,171 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+)
+
+// batchConn is a net.Conn that buffers writes while batching is enabled, so
+// several records are sent in a single write
+type batchConn struct {
+	net.Conn
+	mu    sync.Mutex
+	batch bool
+	buf   bytes.Buffer
+}
+
+func (c *batchConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.batch {
+		return c.buf.Write(p)
+	}
+	return c.Conn.Write(p)
+}
+
+// start enables batching
+func (c *batchConn) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batch = true
+}
+
+// flush sends the buffered writes and disables batching
+func (c *batchConn) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batch = false
+	_, err := c.Conn.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+func TestPendingInput(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		version uint16
+		compact bool
+	}{
+		{"TLS12", tls.VersionTLS12, false},
+		{"TLS13", tls.VersionTLS13, false},
+		{"TLS12Compact", tls.VersionTLS12, true},
+		{"TLS13Compact", tls.VersionTLS13, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testPendingInput(t, tt.version, tt.compact)
+		})
+	}
+}
+
+func testPendingInput(t *testing.T, version uint16, compact bool) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sConn, cConn := net.Pipe()
+	defer sConn.Close()
+	defer cConn.Close()
+
+	bc := &batchConn{Conn: sConn}
+	srv := tls.Server(bc, &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MaxVersion:   version,
+	})
+	errC := make(chan error, 1)
+	go func() {
+		errC <- func() error {
+			if err := srv.Handshake(); err != nil {
+				return err
+			}
+			// Both records are sent in a single write
+			bc.start()
+			if _, err := srv.Write([]byte("first")); err != nil {
+				return err
+			}
+			if _, err := srv.Write([]byte("second")); err != nil {
+				return err
+			}
+			if err := bc.flush(); err != nil {
+				return err
+			}
+			// Echo afterwards
+			recv := make([]byte, 1024)
+			for {
+				n, err := srv.Read(recv)
+				if err != nil {
+					return nil
+				}
+				if _, err := srv.Write(recv[:n]); err != nil {
+					return nil
+				}
+			}
+		}()
+	}()
+
+	cfg := func() *tls.Config {
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         version,
+		}
+	}
+	cli, err := Client(cConn, cfg(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read only part of the first record, the rest of it and the second
+	// record remain buffered
+	recv := make([]byte, 2)
+	if _, err := cli.Read(recv); err != nil {
+		t.Fatal(err)
+	}
+	if string(recv) != "fi" {
+		t.Fatalf("unexpected message %q", recv)
+	}
+
+	state := cli.State()
+	if compact {
+		if state, err = cli.CompactState(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(state.pending.input) == 0 || len(state.pending.rawInput) == 0 {
+		t.Fatal("pending input not captured")
+	}
+	if state.Buffered() != len(state.pending.input)+len(state.pending.rawInput) {
+		t.Fatalf("unexpected buffered bytes %d", state.Buffered())
+	}
+	js, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded State
+	if err := json.Unmarshal(js, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	cli2, err := Client(cConn, cfg(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"rst", "second"} {
+		recv := make([]byte, 1024)
+		n, err := cli2.Read(recv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(recv[:n]) != want {
+			t.Fatalf("expected %q, got %q", want, recv[:n])
+		}
+	}
+	echo(t, cli2)
+
+	cConn.Close()
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+}
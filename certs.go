@@ -0,0 +1,197 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"reflect"
+	"strings"
+
+	intref "github.com/igolaizola/resumetls/internal/reflect"
+)
+
+// skipVerifyConfig returns a copy of cfg that doesn't verify nor call
+// verification callbacks on peer certificates
+func skipVerifyConfig(cfg *tls.Config) *tls.Config {
+	cfg = cfg.Clone()
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = nil
+	cfg.VerifyConnection = nil
+	switch cfg.ClientAuth {
+	case tls.VerifyClientCertIfGiven:
+		cfg.ClientAuth = tls.RequestClientCert
+	case tls.RequireAndVerifyClientCert:
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	}
+	return cfg
+}
+
+// rawChains returns the DER encoding of certificate chains
+func rawChains(chains [][]*x509.Certificate) [][][]byte {
+	var raw [][][]byte
+	for _, chain := range chains {
+		var rawChain [][]byte
+		for _, cert := range chain {
+			rawChain = append(rawChain, cert.Raw)
+		}
+		raw = append(raw, rawChain)
+	}
+	return raw
+}
+
+// parseChains parses DER encoded certificate chains
+func parseChains(raw [][][]byte) ([][]*x509.Certificate, error) {
+	var chains [][]*x509.Certificate
+	for _, rawChain := range raw {
+		var chain []*x509.Certificate
+		for _, der := range rawChain {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, cert)
+		}
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
+// setConfig overrides the config of a tls conn
+func setConfig(conn *tls.Conn, cfg *tls.Config) {
+	r := reflect.ValueOf(conn).Elem()
+	intref.SetFieldValue(r, "config", cfg)
+}
+
+// setVerifiedChains overrides the verified chains of a tls conn
+func setVerifiedChains(conn *tls.Conn, chains [][]*x509.Certificate) {
+	r := reflect.ValueOf(conn).Elem()
+	intref.SetFieldValue(r, "verifiedChains", chains)
+}
+
+// certCapture records the fingerprint of the local certificate presented to
+// the peer. When resuming, the selected certificate must match the fingerprint
+// of the state.
+type certCapture struct {
+	fingerprint []byte
+	expected    []byte
+	resuming    bool
+}
+
+// wrap makes cfg select local certificates through the capture.
+// Certificates are moved to GetCertificate so it is always called.
+func (cc *certCapture) wrap(cfg *tls.Config) {
+	certs := cfg.Certificates
+	nameToCert := cfg.NameToCertificate
+	getCert := cfg.GetCertificate
+	getClientCert := cfg.GetClientCertificate
+	cfg.Certificates = nil
+	cfg.NameToCertificate = nil
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := serverCertificate(hello, certs, nameToCert, getCert)
+		if err != nil {
+			return nil, err
+		}
+		return cert, cc.record(cert)
+	}
+	cfg.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := clientCertificate(cri, certs, getClientCert)
+		if err != nil {
+			return nil, err
+		}
+		return cert, cc.record(cert)
+	}
+}
+
+// record stores the fingerprint of the selected certificate
+func (cc *certCapture) record(cert *tls.Certificate) error {
+	fingerprint := certFingerprint(cert)
+	if cc.resuming && !bytes.Equal(fingerprint, cc.expected) {
+		return mismatchError("local certificate differs from the state")
+	}
+	cc.fingerprint = fingerprint
+	return nil
+}
+
+// certFingerprint returns the SHA-256 of the leaf certificate or nil if there
+// is no certificate
+func certFingerprint(cert *tls.Certificate) []byte {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return sum[:]
+}
+
+// checkCertificates checks that a static config can present the certificate
+// with the given fingerprint, configs with certificate callbacks aren't
+// checked
+func checkCertificates(cfg *tls.Config, fingerprint []byte, role Role) error {
+	if len(fingerprint) == 0 {
+		return nil
+	}
+	if role == RoleClient && cfg.GetClientCertificate != nil {
+		return nil
+	}
+	if role == RoleServer && (cfg.GetCertificate != nil || cfg.GetConfigForClient != nil) {
+		return nil
+	}
+	for i := range cfg.Certificates {
+		if bytes.Equal(certFingerprint(&cfg.Certificates[i]), fingerprint) {
+			return nil
+		}
+	}
+	return mismatchError("local certificate not found in config")
+}
+
+// serverCertificate selects the server certificate the same way
+// crypto/tls does
+func serverCertificate(hello *tls.ClientHelloInfo, certs []tls.Certificate, nameToCert map[string]*tls.Certificate, getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if getCert != nil && (len(certs) == 0 || len(hello.ServerName) > 0) {
+		cert, err := getCert(hello)
+		if cert != nil || err != nil {
+			return cert, err
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("tls: no certificates configured")
+	}
+	if len(certs) == 1 {
+		return &certs[0], nil
+	}
+	if nameToCert != nil {
+		name := strings.ToLower(hello.ServerName)
+		if cert, ok := nameToCert[name]; ok {
+			return cert, nil
+		}
+		if len(name) > 0 {
+			labels := strings.Split(name, ".")
+			labels[0] = "*"
+			if cert, ok := nameToCert[strings.Join(labels, ".")]; ok {
+				return cert, nil
+			}
+		}
+	}
+	for i := range certs {
+		if err := hello.SupportsCertificate(&certs[i]); err == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
+
+// clientCertificate selects the client certificate the same way crypto/tls
+// does
+func clientCertificate(cri *tls.CertificateRequestInfo, certs []tls.Certificate, getClientCert func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if getClientCert != nil {
+		return getClientCert(cri)
+	}
+	for i := range certs {
+		if err := cri.SupportsCertificate(&certs[i]); err == nil {
+			return &certs[i], nil
+		}
+	}
+	// No acceptable certificate found, don't send a certificate
+	return new(tls.Certificate), nil
+}
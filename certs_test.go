@@ -0,0 +1,106 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResumeVerification(t *testing.T) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+	srv := tls.Server(sConn, &tls.Config{
+		Certificates: []tls.Certificate{pair},
+	})
+	go func() {
+		defer srv.Close()
+		recv := make([]byte, 1024)
+		for {
+			n, err := srv.Read(recv)
+			if err != nil {
+				return
+			}
+			if _, err := srv.Write(recv[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	var verifyCalls, connectionCalls int
+	cfg := func() *tls.Config {
+		return &tls.Config{
+			RootCAs:    roots,
+			ServerName: "localhost",
+			VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+				verifyCalls++
+				return nil
+			},
+			VerifyConnection: func(tls.ConnectionState) error {
+				connectionCalls++
+				return nil
+			},
+		}
+	}
+
+	// The test certificate is expired, the initial handshake is performed
+	// while it was still valid
+	initCfg := cfg()
+	initCfg.Time = func() time.Time {
+		return leaf.NotAfter.Add(-time.Hour)
+	}
+	cli, err := Client(cConn, initCfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, cli)
+	if verifyCalls != 1 || connectionCalls != 1 {
+		t.Fatalf("unexpected callback calls: %d, %d", verifyCalls, connectionCalls)
+	}
+	state := cli.State()
+	data, err := state.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-verification fails because the certificate is expired now
+	if _, err := Client(cConn, cfg(), state, WithReverify()); err == nil {
+		t.Fatal("expected verification error")
+	}
+	verifyCalls, connectionCalls = 0, 0
+
+	// By default the original verification is restored
+	cli2, err := Client(cConn, cfg(), state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifyCalls != 0 || connectionCalls != 0 {
+		t.Fatalf("unexpected callback calls: %d, %d", verifyCalls, connectionCalls)
+	}
+	cs := cli2.ConnectionState()
+	if len(cs.PeerCertificates) != 1 || !cs.PeerCertificates[0].Equal(leaf) {
+		t.Fatal("peer certificates not restored")
+	}
+	if len(cs.VerifiedChains) != 1 || len(cs.VerifiedChains[0]) != 1 || !cs.VerifiedChains[0][0].Equal(leaf) {
+		t.Fatal("verified chains not restored")
+	}
+	echo(t, cli2)
+}
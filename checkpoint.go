@@ -0,0 +1,201 @@
+package resumetls
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checkpointTimeout bounds how long a checkpoint waits for the interrupted
+// reads and for the store before giving up until the next trigger
+const checkpointTimeout = 5 * time.Second
+
+// errWriting is returned when a checkpoint is skipped because a write is in
+// flight
+var errWriting = errors.New("resumetls: write in flight")
+
+// CheckpointPolicy sets when a conn checkpoints its state, a checkpoint is
+// taken as soon as any of the non zero limits is reached
+type CheckpointPolicy struct {
+	// Records is the number of records sent by writes and received by reads
+	// since the last checkpoint
+	Records int
+	// Bytes is the number of application data bytes written and read since
+	// the last checkpoint
+	Bytes int
+	// Interval is the time since the last checkpoint, idle conns aren't
+	// checkpointed again
+	Interval time.Duration
+	// OnError is called with the errors of failed checkpoints, which are
+	// retried with the next trigger
+	OnError func(error)
+}
+
+// WithCheckpoint makes the conn save its state to the store with the given id
+// whenever the policy is met, so a crashed process can resume the conn from
+// the most recent checkpoint.
+// Checkpoints pause the conn as Pause does, so states are only taken at
+// record boundaries, but they never wait for writes: a checkpoint due while a
+// write is in flight is skipped and taken after the write. Reads blocked
+// waiting for data are interrupted and retried transparently, so the conn is
+// only paused while its state is taken. A conn paused by the application
+// isn't checkpointed, Pause waits for a checkpoint in progress.
+// Every conn needs its own id, so the option can't be shared by the conns of
+// a Listener.
+func WithCheckpoint(store StateStore, id string, policy CheckpointPolicy) Option {
+	return func(o *options) {
+		o.checkpoint = &checkpointConfig{store: store, id: id, policy: policy}
+	}
+}
+
+// checkpointConfig is the configuration set by WithCheckpoint
+type checkpointConfig struct {
+	store  StateStore
+	id     string
+	policy CheckpointPolicy
+}
+
+// checkpointer saves the state of a conn in the background
+type checkpointer struct {
+	*checkpointConfig
+	conn    *Conn
+	records atomic.Int64
+	bytes   atomic.Int64
+	trigger chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// startCheckpoints starts checkpointing the conn, nil is returned if it
+// isn't configured
+func startCheckpoints(c *Conn, cfg *checkpointConfig) *checkpointer {
+	if cfg == nil {
+		return nil
+	}
+	cp := &checkpointer{
+		checkpointConfig: cfg,
+		conn:             c,
+		trigger:          make(chan struct{}, 1),
+		done:             make(chan struct{}),
+	}
+	go cp.run()
+	return cp
+}
+
+// seq returns the sequence number of the "in" or "out" half conn before a
+// read or a write, so count can account the records it processed
+func (cp *checkpointer) seq(half string) uint64 {
+	if cp == nil {
+		return 0
+	}
+	mu := halfMutex(cp.conn.Conn, half)
+	mu.Lock()
+	defer mu.Unlock()
+	seq := getSeq(cp.conn.Conn, half)
+	return binary.BigEndian.Uint64(seq[:])
+}
+
+// count accounts the records and the application data of a read or a write
+// from the sequence number of the half conn before it, and triggers a
+// checkpoint if a limit is reached
+func (cp *checkpointer) count(half string, before uint64, n int) {
+	if cp == nil || n == 0 {
+		return
+	}
+	// TLS 1.3 key updates reset sequence numbers, records before the update
+	// aren't counted
+	records := cp.seq(half)
+	if records >= before {
+		records -= before
+	}
+	r := cp.records.Add(int64(records))
+	b := cp.bytes.Add(int64(n))
+	p := cp.policy
+	if (p.Records > 0 && r >= int64(p.Records)) || (p.Bytes > 0 && b >= int64(p.Bytes)) {
+		cp.signal()
+	}
+}
+
+// signal triggers a checkpoint, which is taken once the pending one is done
+func (cp *checkpointer) signal() {
+	if cp == nil {
+		return
+	}
+	select {
+	case cp.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run takes checkpoints until the conn is closed
+func (cp *checkpointer) run() {
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if cp.policy.Interval > 0 {
+		ticker = time.NewTicker(cp.policy.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var saved bool
+	for {
+		select {
+		case <-cp.done:
+			return
+		case <-tick:
+			// Idle conns have the same state as the last checkpoint
+			if saved && cp.bytes.Load() == 0 {
+				continue
+			}
+		case <-cp.trigger:
+		}
+		if !cp.conn.isHandshaked() {
+			continue
+		}
+		err := cp.checkpoint()
+		switch {
+		case err == nil:
+			saved = true
+			if ticker != nil {
+				ticker.Reset(cp.policy.Interval)
+			}
+		case errors.Is(err, net.ErrClosed):
+			return
+		case errors.Is(err, errPaused):
+			// Paused by the application, which owns the state meanwhile
+		case errors.Is(err, errWriting):
+			// Retried once the writes in flight exit, the counters aren't
+			// reset
+		case cp.policy.OnError != nil:
+			cp.policy.OnError(err)
+		}
+	}
+}
+
+// checkpoint pauses the conn and saves its state
+func (cp *checkpointer) checkpoint() error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointTimeout)
+	defer cancel()
+	state, err := cp.conn.pause(ctx, true)
+	if err != nil {
+		return err
+	}
+	// The counters are reset while no reads or writes are in flight
+	cp.records.Store(0)
+	cp.bytes.Store(0)
+	cp.conn.Unpause()
+	return cp.store.Save(ctx, cp.id, state)
+}
+
+// stop stops taking checkpoints
+func (cp *checkpointer) stop() {
+	if cp == nil {
+		return
+	}
+	cp.once.Do(func() {
+		close(cp.done)
+	})
+}
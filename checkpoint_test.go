@@ -0,0 +1,190 @@
+package resumetls
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts the states saved to a memory store
+type countingStore struct {
+	*MemoryStore
+	saves atomic.Int64
+}
+
+func (s *countingStore) Save(ctx context.Context, id string, state *State) error {
+	s.saves.Add(1)
+	return s.MemoryStore.Save(ctx, id, state)
+}
+
+// checkpointedClient returns a handshaked client checkpointed with the policy
+// and talking to a tls echo server
+func checkpointedClient(t *testing.T, store StateStore, policy CheckpointPolicy) *Conn {
+	t.Helper()
+	policy.OnError = func(err error) {
+		t.Errorf("checkpoint failed: %v", err)
+	}
+	cli, _ := handshakedConn(t, true, &tls.Config{InsecureSkipVerify: true},
+		&tls.Config{Certificates: []tls.Certificate{newCertificate(t)}}, WithCheckpoint(store, "cli", policy))
+	t.Cleanup(func() { _ = cli.Close() })
+	return cli
+}
+
+// waitSaves waits until the store saved n states
+func waitSaves(t *testing.T, store *countingStore, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for store.saves.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d checkpoints, got %d", n, store.saves.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCheckpointRecords(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	cli := checkpointedClient(t, store, CheckpointPolicy{Records: 6})
+
+	// Every echo sends and receives a record, the handshaked client already
+	// echoed once
+	echo(t, cli)
+	time.Sleep(50 * time.Millisecond)
+	if n := store.saves.Load(); n != 0 {
+		t.Fatalf("unexpected checkpoints %d", n)
+	}
+	echo(t, cli)
+	waitSaves(t, store, 1)
+
+	// The checkpoint matches the conn
+	state, err := store.Load(context.Background(), "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	current, err := cli.Pause(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Unpause()
+	in, out := state.RecordSequence()
+	wantIn, wantOut := current.RecordSequence()
+	if in != wantIn || out != wantOut {
+		t.Fatalf("checkpoint sequence %d %d, expected %d %d", in, out, wantIn, wantOut)
+	}
+}
+
+func TestCheckpointInterval(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	cli := checkpointedClient(t, store, CheckpointPolicy{Interval: 20 * time.Millisecond})
+	waitSaves(t, store, 1)
+
+	// Idle conns aren't checkpointed again
+	time.Sleep(100 * time.Millisecond)
+	if n := store.saves.Load(); n != 1 {
+		t.Fatalf("unexpected checkpoints %d", n)
+	}
+	echo(t, cli)
+	waitSaves(t, store, 2)
+
+	// Conns paused by the application aren't checkpointed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := cli.Pause(ctx); err != nil {
+		t.Fatal(err)
+	}
+	saves := store.saves.Load()
+	time.Sleep(100 * time.Millisecond)
+	if n := store.saves.Load(); n != saves {
+		t.Fatalf("unexpected checkpoints %d while paused", n)
+	}
+	cli.Unpause()
+}
+
+func TestCheckpointWriting(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	cli := checkpointedClient(t, store, CheckpointPolicy{Records: 1})
+	waitSaves(t, store, 1)
+
+	// The write blocks until its echo is read, the checkpoints triggered by
+	// the reads meanwhile are skipped instead of blocking them
+	data := make([]byte, 1<<20)
+	errC := make(chan error, 1)
+	go func() {
+		_, err := cli.Write(data)
+		errC <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	saves := store.saves.Load()
+	go func() {
+		_, err := io.ReadFull(cli, data)
+		errC <- err
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errC:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("read blocked by a checkpoint")
+		}
+	}
+
+	// The skipped checkpoint is taken after the write
+	waitSaves(t, store, saves+1)
+}
+
+func TestCheckpointIntervalWriting(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	cli := checkpointedClient(t, store, CheckpointPolicy{Interval: 300 * time.Millisecond})
+	waitSaves(t, store, 1)
+	echo(t, cli)
+
+	// The ticks are skipped while the write is blocked until its echo is read
+	data := make([]byte, 1<<20)
+	errC := make(chan error, 1)
+	go func() {
+		_, err := cli.Write(data)
+		errC <- err
+	}()
+	time.Sleep(400 * time.Millisecond)
+	saves := store.saves.Load()
+	if _, err := io.ReadFull(cli, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+
+	// The skipped checkpoint is taken when the write exits instead of
+	// waiting for the next tick
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for store.saves.Load() == saves {
+		if time.Now().After(deadline) {
+			t.Fatal("skipped checkpoint not retried after the write")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCheckpointRecordsWritten(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	policy := CheckpointPolicy{Records: 4, OnError: func(err error) {
+		t.Errorf("checkpoint failed: %v", err)
+	}}
+	cli, _, _, _ := resumablePair(t, &tls.Config{InsecureSkipVerify: true},
+		&tls.Config{Certificates: []tls.Certificate{newCertificate(t)}}, WithCheckpoint(store, "cli", policy))
+	defer cli.Close()
+
+	// crypto/tls sends the first writes of a conn in records smaller than
+	// the maximum size, the records sent are counted
+	if _, err := cli.Write(make([]byte, 1<<14)); err != nil {
+		t.Fatal(err)
+	}
+	waitSaves(t, store, 1)
+}
@@ -0,0 +1,234 @@
+//go:build linux
+
+// Command restart is a TLS echo server that restarts its binary on SIGHUP
+// without dropping its clients.
+//
+// The new process inherits the listener and receives every established
+// connection along with its state through the handoff package.
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/igolaizola/resumetls"
+	"github.com/igolaizola/resumetls/handoff"
+)
+
+// Environment variables used to pass data to the new process
+const (
+	handoffEnv = "RESTART_HANDOFF"
+	certEnv    = "RESTART_CERT"
+	keyEnv     = "RESTART_KEY"
+)
+
+// Inherited file descriptors
+const (
+	listenerFD = 3
+	handoffFD  = 4
+)
+
+func main() {
+	addr := flag.String("addr", ":4433", "listen address")
+	flag.Parse()
+	if err := run(*addr); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(addr string) error {
+	cert, err := loadCert()
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// A restarted process inherits the listener and the connections of the
+	// previous one
+	var inner net.Listener
+	var snapshots []resumetls.ConnSnapshot
+	if os.Getenv(handoffEnv) != "" {
+		if inner, err = net.FileListener(os.NewFile(listenerFD, "listener")); err != nil {
+			return fmt.Errorf("couldn't inherit listener: %w", err)
+		}
+		if snapshots, err = receive(os.NewFile(handoffFD, "handoff")); err != nil {
+			return err
+		}
+	} else if inner, err = net.Listen("tcp", addr); err != nil {
+		return fmt.Errorf("couldn't listen: %w", err)
+	}
+	ln := resumetls.NewListener(inner, cfg)
+	conns, err := ln.Restore(context.Background(), snapshots)
+	if err != nil {
+		log.Printf("Couldn't restore connections: %v", err)
+	}
+	for _, c := range conns {
+		log.Printf("Resumed connection from %s", c.RemoteAddr())
+		go serve(c)
+	}
+	log.Printf("Process %d listening on %s", os.Getpid(), inner.Addr())
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	<-sig
+	return restart(inner.(*net.TCPListener), ln)
+}
+
+// serve echoes data until the client closes the connection, handed off
+// connections are closed without affecting the new process
+func serve(c net.Conn) {
+	defer c.Close()
+	if _, err := io.Copy(c, c); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Connection error: %v", err)
+	}
+}
+
+// receive receives the connections handed off by the previous process
+func receive(f *os.File) ([]resumetls.ConnSnapshot, error) {
+	conn, err := net.FileConn(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open handoff socket: %w", err)
+	}
+	uc := conn.(*net.UnixConn)
+	defer uc.Close()
+	var snapshots []resumetls.ConnSnapshot
+	for {
+		conn, state, err := handoff.Receive(uc)
+		if errors.Is(err, io.EOF) {
+			return snapshots, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, resumetls.ConnSnapshot{Conn: conn, State: state})
+	}
+}
+
+// restart launches a new process and hands off the listener and every
+// established connection
+func restart(inner *net.TCPListener, ln *resumetls.Listener) error {
+	lnFile, err := inner.File()
+	if err != nil {
+		return fmt.Errorf("couldn't get listener file: %w", err)
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("couldn't create handoff socket: %w", err)
+	}
+	childFile := os.NewFile(uintptr(fds[1]), "handoff")
+	parentFile := os.NewFile(uintptr(fds[0]), "handoff")
+	conn, err := net.FileConn(parentFile)
+	_ = parentFile.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't open handoff socket: %w", err)
+	}
+	uc := conn.(*net.UnixConn)
+	defer uc.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), handoffEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, childFile}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("couldn't start new process: %w", err)
+	}
+	_ = childFile.Close()
+	_ = lnFile.Close()
+
+	// The new process accepts connections from now on
+	_ = ln.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	snapshots, err := ln.Snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't snapshot connections: %w", err)
+	}
+	for _, s := range snapshots {
+		if err := handoff.Send(uc, s.Conn, s.State); err != nil {
+			return err
+		}
+		// Only the file descriptor is closed, the new process keeps the
+		// connection open
+		_ = s.Conn.Close()
+	}
+	log.Printf("Process %d handed off %d connections to %d", os.Getpid(), len(snapshots), cmd.Process.Pid)
+	return nil
+}
+
+// loadCert loads the certificate of the previous process or generates a new
+// one, which is passed to the next process
+func loadCert() (tls.Certificate, error) {
+	certPEM, keyPEM := os.Getenv(certEnv), os.Getenv(keyEnv)
+	if certPEM == "" || keyPEM == "" {
+		var err error
+		if certPEM, keyPEM, err = generateCert(); err != nil {
+			return tls.Certificate{}, err
+		}
+		_ = os.Setenv(certEnv, certPEM)
+		_ = os.Setenv(keyEnv, keyPEM)
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("couldn't load certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// generateCert generates a self signed certificate in PEM format
+func generateCert() (string, string, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't generate private key: %w", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't create certificate: %w", err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't marshal private key: %w", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	return string(certPEM), string(keyPEM), nil
+}
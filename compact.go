@@ -0,0 +1,275 @@
+package resumetls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	intref "github.com/igolaizola/resumetls/internal/reflect"
+	"github.com/igolaizola/resumetls/internal/suite"
+	"github.com/igolaizola/resumetls/internal/tlscipher"
+)
+
+// errNoEKM is returned when exporting keying material from a connection
+// restored from a compact state
+var errNoEKM = errors.New("resumetls: keying material export not available on compact connections")
+
+// errHandshakeIncomplete is returned when the state of a conn is requested
+// before completing the handshake
+var errHandshakeIncomplete = errors.New("resumetls: handshake not completed")
+
+// trafficKeys contains the record keys of both directions
+type trafficKeys struct {
+	in  suite.Keys
+	out suite.Keys
+}
+
+// compact returns whether the state contains key material instead of
+// handshake data
+func (s *State) compact() bool {
+	return len(s.inKeys.Key) > 0
+}
+
+// CompactState gets the data in order to resume a connection without
+// replaying the handshake.
+// It only contains the negotiated version, cipher suite, record keys and
+// sequence numbers, so it is much smaller than State but the resumed
+// connection can't export keying material nor report peer certificates.
+// Only TLS 1.2 and TLS 1.3 with AEAD or CBC cipher suites are supported.
+func (c *Conn) CompactState() (*State, error) {
+	if !c.isHandshaked() {
+		return nil, errHandshakeIncomplete
+	}
+	in, out, cipherSuite := getState(c.Conn)
+	version := getVersion(c.Conn)
+	s, err := suite.Lookup(version, cipherSuite)
+	if err != nil {
+		return nil, fmt.Errorf("resumetls: compact state not supported: %w", err)
+	}
+
+	// TLS 1.3 keys are derived from the current traffic secrets, which
+	// change after key updates
+	var keys trafficKeys
+	inSecret, outSecret := getTrafficSecrets(c.Conn)
+	if version == tls.VersionTLS13 && len(inSecret) > 0 {
+		keys.in = s.KeysFromTrafficSecret(inSecret)
+		keys.out = s.KeysFromTrafficSecret(outSecret)
+	} else {
+		if c.keys == nil {
+			return nil, fmt.Errorf("resumetls: compact state not supported: %w", c.keysErr)
+		}
+		keys = *c.keys
+	}
+	_, tickets, _ := c.sessions.snapshot()
+	var resumptionSecret []byte
+	if version == tls.VersionTLS13 {
+		resumptionSecret = cloneBytes(getResumptionSecret(c.Conn))
+	}
+
+	return &State{
+		inSeq:            in,
+		outSeq:           out,
+		cipherSuite:      cipherSuite,
+		version:          version,
+		inKeys:           keys.in,
+		outKeys:          keys.out,
+		serverName:       c.Conn.ConnectionState().ServerName,
+		certFingerprint:  c.certs.fingerprint,
+		role:             c.role,
+		pending:          getBuffers(c.Conn),
+		inSecret:         cloneBytes(inSecret),
+		outSecret:        cloneBytes(outSecret),
+		tickets:          tickets,
+		resumptionSecret: resumptionSecret,
+	}, nil
+}
+
+// restore restores a resumable TLS conn from a compact state
+func restore(role Role, conn net.Conn, cfg *tls.Config, state *State) (*Conn, error) {
+	if err := state.checkConfig(cfg, role); err != nil {
+		return nil, err
+	}
+	if err := checkCertificates(cfg, state.certFingerprint, role); err != nil {
+		return nil, err
+	}
+
+	s, err := suite.Lookup(state.version, state.cipherSuite)
+	if err != nil {
+		return nil, corruptError(fmt.Errorf("couldn't restore compact state: %w", err))
+	}
+	inCipher, inMAC, err := tlscipher.New(s, state.version, state.inKeys, true)
+	if err != nil {
+		return nil, corruptError(fmt.Errorf("couldn't restore compact state: %w", err))
+	}
+	outCipher, outMAC, err := tlscipher.New(s, state.version, state.outKeys, false)
+	if err != nil {
+		return nil, corruptError(fmt.Errorf("couldn't restore compact state: %w", err))
+	}
+
+	// Session tickets received after the handshake are derived from the
+	// resumption secret
+	sessions := &sessionCapture{tickets: slices.Clone(state.tickets)}
+	sessions.wrap(cfg)
+	c := newTLSConn(role, conn, cfg)
+	r := reflect.ValueOf(c).Elem()
+	intref.SetFieldValue(r, "vers", state.version)
+	intref.SetFieldValue(r, "haveVers", true)
+	intref.SetFieldValue(r, "handshakes", 1)
+	intref.SetFieldValue(r, "serverName", state.serverName)
+	intref.SetFieldValue(r, "ekm", func(string, []byte, int) ([]byte, error) {
+		return nil, errNoEKM
+	})
+	for _, half := range []struct {
+		name   string
+		cipher any
+		mac    any
+	}{
+		{"in", inCipher, inMAC},
+		{"out", outCipher, outMAC},
+	} {
+		f := r.FieldByName(half.name)
+		intref.SetFieldValue(f, "version", state.version)
+		intref.SetFieldValue(f, "cipher", half.cipher)
+		if half.mac != nil {
+			intref.SetFieldValue(f, "mac", half.mac)
+		}
+	}
+	if len(state.inSecret) > 0 {
+		if err := setTrafficSecrets(c, s, state.inSecret, state.outSecret); err != nil {
+			return nil, corruptError(fmt.Errorf("couldn't restore compact state: %w", err))
+		}
+	}
+	if len(state.resumptionSecret) > 0 {
+		setResumptionSecret(c, state.resumptionSecret)
+	}
+	setState(c, state.inSeq, state.outSeq, state.cipherSuite)
+	setBuffers(c, state.pending)
+	(*atomic.Bool)(intref.FieldPointer(r, "isHandshakeComplete")).Store(true)
+
+	rc := &Conn{
+		role:     role,
+		compact:  true,
+		keys:     &trafficKeys{in: state.inKeys, out: state.outKeys},
+		certs:    &certCapture{fingerprint: state.certFingerprint},
+		sessions: sessions,
+		Conn:     c,
+	}
+	rc.handshaked.Store(true)
+	return rc, nil
+}
+
+// establishKeys obtains TLS 1.2 record keys from the captured key log and
+// server hello, TLS 1.3 keys are obtained from the current traffic secrets
+func (c *Conn) establishKeys() {
+	sent := c.sentBuffer
+	keyLog := c.keyLogBuffer
+	c.sentBuffer = nil
+	c.keyLogBuffer = nil
+	// Resumed conns keep the key log of their state
+	if len(c.keyLog) == 0 && keyLog != nil {
+		c.keyLog = bytes.Clone(keyLog.Bytes())
+	}
+
+	if getVersion(c.Conn) != tls.VersionTLS12 {
+		return
+	}
+	c.keys, c.keysErr = func() (*trafficKeys, error) {
+		_, _, cipherSuite := getState(c.Conn)
+		s, err := suite.Lookup(tls.VersionTLS12, cipherSuite)
+		if err != nil {
+			return nil, err
+		}
+		isClient := c.role == RoleClient
+		clientHello, serverHello := sent.Bytes(), c.connBuffer.Bytes()
+		if !isClient {
+			clientHello, serverHello = serverHello, clientHello
+		}
+		clientRandom, masterSecret, err := parseKeyLog(keyLog.Bytes())
+		if err != nil && c.Conn.ConnectionState().DidResume {
+			// Abbreviated handshakes don't log the master secret, it is
+			// obtained from the resumed session
+			if masterSecret, err = c.sessions.masterSecret(); err != nil {
+				return nil, err
+			}
+			if clientRandom, err = suite.ClientRandom(clientHello); err != nil {
+				return nil, err
+			}
+			if _, _, err := parseKeyLog(c.keyLog); err != nil {
+				c.keyLog = appendKeyLog(c.keyLog, keyLogClientRandom, clientRandom, masterSecret)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		serverRandom, err := suite.ServerRandom(serverHello)
+		if err != nil {
+			return nil, err
+		}
+		client, server := s.KeysFromMasterSecret(masterSecret, clientRandom, serverRandom)
+		if isClient {
+			return &trafficKeys{in: server, out: client}, nil
+		}
+		return &trafficKeys{in: client, out: server}, nil
+	}()
+}
+
+// teeKeyLog returns a key log writer that also writes to buf
+func teeKeyLog(w io.Writer, buf *bytes.Buffer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(w, buf)
+}
+
+// parseKeyLog returns the client random and master secret of the last
+// CLIENT_RANDOM line of an NSS key log
+func parseKeyLog(keyLog []byte) ([]byte, []byte, error) {
+	var clientRandom, masterSecret []byte
+	scanner := bufio.NewScanner(bytes.NewReader(keyLog))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "CLIENT_RANDOM" {
+			continue
+		}
+		cr, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid key log: %w", err)
+		}
+		ms, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid key log: %w", err)
+		}
+		clientRandom, masterSecret = cr, ms
+	}
+	if masterSecret == nil {
+		return nil, nil, errors.New("master secret not found in key log")
+	}
+	return clientRandom, masterSecret, nil
+}
+
+// getVersion obtains the negotiated tls version
+func getVersion(conn *tls.Conn) uint16 {
+	r := reflect.ValueOf(conn).Elem()
+	return intref.FieldToInterface(r, "vers").(uint16)
+}
+
+// getTrafficSecrets obtains the current TLS 1.3 traffic secrets
+func getTrafficSecrets(conn *tls.Conn) ([]byte, []byte) {
+	return getTrafficSecret(conn, "in"), getTrafficSecret(conn, "out")
+}
+
+// getTrafficSecret obtains the current TLS 1.3 traffic secret of the "in" or
+// "out" half conn
+func getTrafficSecret(conn *tls.Conn, half string) []byte {
+	r := reflect.ValueOf(conn).Elem()
+	return intref.FieldToInterface(r.FieldByName(half), "trafficSecret").([]byte)
+}
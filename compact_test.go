@@ -0,0 +1,116 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"testing"
+)
+
+var compactCiphers = []struct {
+	name    string
+	version uint16
+	ciphers []uint16
+}{
+	{"TLS_AES_128_GCM_SHA256", tls.VersionTLS13, []uint16{tls.TLS_AES_128_GCM_SHA256}},
+	{"TLS_AES_256_GCM_SHA384", tls.VersionTLS13, []uint16{tls.TLS_AES_256_GCM_SHA384}},
+	{"TLS_CHACHA20_POLY1305_SHA256", tls.VersionTLS13, []uint16{tls.TLS_CHACHA20_POLY1305_SHA256}},
+	{"TLS_RSA_WITH_3DES_EDE_CBC_SHA", tls.VersionTLS12, []uint16{tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA}},
+	{"TLS_RSA_WITH_AES_128_CBC_SHA", tls.VersionTLS12, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}},
+	{"TLS_RSA_WITH_AES_128_CBC_SHA256", tls.VersionTLS12, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA256}},
+	{"TLS_RSA_WITH_AES_256_GCM_SHA384", tls.VersionTLS12, []uint16{tls.TLS_RSA_WITH_AES_256_GCM_SHA384}},
+	{"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA}},
+	{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+	{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}},
+	{"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}},
+}
+
+func TestCompactState(t *testing.T) {
+	for _, tt := range compactCiphers {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, client := range []bool{true, false} {
+				for i := 0; i < 10; i++ {
+					testCompactState(t, client, tt.version, tt.ciphers)
+				}
+			}
+		})
+	}
+}
+
+func testCompactState(t *testing.T, client bool, version uint16, ciphers []uint16) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliCfg := func() *tls.Config {
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			CipherSuites:       ciphers,
+			MinVersion:         version,
+			MaxVersion:         version,
+		}
+	}
+	srvCfg := func() *tls.Config {
+		return &tls.Config{
+			Certificates: []tls.Certificate{pair},
+			CipherSuites: ciphers,
+			MinVersion:   version,
+			MaxVersion:   version,
+		}
+	}
+	newConn := Client
+	cfg, peerCfg := cliCfg, srvCfg
+	if !client {
+		newConn = Server
+		cfg, peerCfg = srvCfg, cliCfg
+	}
+	c, conn := handshakedConn(t, client, cfg(), peerCfg())
+
+	state, err := c.CompactState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs := c.ConnectionState().CipherSuite; state.cipherSuite != cs {
+		t.Fatalf("unexpected cipher suite %s", tls.CipherSuiteName(cs))
+	}
+	data, err := state.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := c.State().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(full)/2 {
+		t.Errorf("compact state isn't compact: %d bytes, full state %d bytes", len(data), len(full))
+	}
+	var decoded State
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resume from the compact state
+	c2, err := newConn(conn, cfg(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c2)
+	echo(t, c2)
+
+	// Compact connections keep returning compact states
+	if !c2.State().compact() {
+		t.Fatal("expected compact state")
+	}
+	js, err := json.Marshal(c2.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON State
+	if err := json.Unmarshal(js, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	c3, err := newConn(conn, cfg(), &fromJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c3)
+}
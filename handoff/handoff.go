@@ -0,0 +1,34 @@
+// Package handoff passes live TLS connections to another process, so a server
+// binary can be restarted without dropping its clients.
+//
+// On Linux, Send transfers the file descriptor of the network connection over
+// a Unix domain socket (SCM_RIGHTS) along with the binary encoded state of the
+// resumable conn, and Receive obtains both in the new process, which resumes
+// the connection with resumetls.Server or resumetls.Client.
+package handoff
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// headerLen is the length of the message header, which carries the file
+// descriptor and the big endian length of the encoded state
+const headerLen = 4
+
+// maxStateLen limits the length of received states
+const maxStateLen = 16 << 20
+
+// appendHeader appends the message header of a state with length n
+func appendHeader(b []byte, n int) []byte {
+	return binary.BigEndian.AppendUint32(b, uint32(n))
+}
+
+// parseHeader returns the length of the state that follows a message header
+func parseHeader(header []byte) (int, error) {
+	n := binary.BigEndian.Uint32(header)
+	if n == 0 || n > maxStateLen {
+		return 0, fmt.Errorf("handoff: invalid state length %d", n)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,136 @@
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/igolaizola/resumetls"
+)
+
+// Send sends the file descriptor of conn and the state of the resumable conn
+// established over it to the process at the other end of uc.
+// The resumable conn must be paused to obtain the state and it must not be
+// used afterwards. Once sent, conn can be closed without affecting the
+// receiver, but the resumable conn can't, since that would send a close
+// notify alert to the peer.
+func Send(uc *net.UnixConn, conn net.Conn, state *resumetls.State) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("handoff: %T doesn't have a file descriptor", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("handoff: couldn't get raw conn: %w", err)
+	}
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("handoff: couldn't encode state: %w", err)
+	}
+	if len(data) > maxStateLen {
+		return fmt.Errorf("handoff: state too large (%d bytes)", len(data))
+	}
+
+	// The header carries the file descriptor, the state is written after it
+	// since it may not fit in a single message
+	header := appendHeader(nil, len(data))
+	var sendErr error
+	if err := raw.Control(func(fd uintptr) {
+		var n int
+		n, _, sendErr = uc.WriteMsgUnix(header, syscall.UnixRights(int(fd)), nil)
+		if sendErr == nil && n != len(header) {
+			sendErr = io.ErrShortWrite
+		}
+	}); err != nil {
+		return fmt.Errorf("handoff: couldn't access file descriptor: %w", err)
+	}
+	if sendErr != nil {
+		return fmt.Errorf("handoff: couldn't send file descriptor: %w", sendErr)
+	}
+	if _, err := uc.Write(data); err != nil {
+		return fmt.Errorf("handoff: couldn't send state: %w", err)
+	}
+	return nil
+}
+
+// Receive receives a connection and its state sent with Send.
+// It returns io.EOF when the sender closes uc without sending more
+// connections.
+func Receive(uc *net.UnixConn) (net.Conn, *resumetls.State, error) {
+	header := make([]byte, headerLen)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, flags, _, err := uc.ReadMsgUnix(header, oob)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, io.EOF
+		}
+		return nil, nil, fmt.Errorf("handoff: couldn't receive file descriptor: %w", err)
+	}
+	if n == 0 && oobn == 0 {
+		return nil, nil, io.EOF
+	}
+	fd, err := parseRights(oob[:oobn], flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	file := os.NewFile(uintptr(fd), "handoff")
+	conn, err := net.FileConn(file)
+	_ = file.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("handoff: couldn't create conn: %w", err)
+	}
+
+	state, err := receiveState(uc, header, n)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, state, nil
+}
+
+// receiveState reads the rest of the header and the state that follows it
+func receiveState(uc *net.UnixConn, header []byte, n int) (*resumetls.State, error) {
+	if _, err := io.ReadFull(uc, header[n:]); err != nil {
+		return nil, fmt.Errorf("handoff: couldn't receive header: %w", err)
+	}
+	length, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(uc, data); err != nil {
+		return nil, fmt.Errorf("handoff: couldn't receive state: %w", err)
+	}
+	var state resumetls.State
+	if err := state.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("handoff: couldn't decode state: %w", err)
+	}
+	return &state, nil
+}
+
+// parseRights returns the single file descriptor of a control message, any
+// other received descriptor is closed
+func parseRights(oob []byte, flags int) (int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, fmt.Errorf("handoff: couldn't parse control message: %w", err)
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != 1 || flags&syscall.MSG_CTRUNC != 0 {
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+		return 0, fmt.Errorf("handoff: expected one file descriptor, got %d", len(fds))
+	}
+	return fds[0], nil
+}
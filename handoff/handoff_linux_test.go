@@ -0,0 +1,232 @@
+package handoff_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/igolaizola/resumetls"
+	"github.com/igolaizola/resumetls/handoff"
+)
+
+// Environment variables used to run the test binary as the child process
+const (
+	childEnv     = "HANDOFF_TEST_CHILD"
+	childCertEnv = "HANDOFF_TEST_CERT"
+	childKeyEnv  = "HANDOFF_TEST_KEY"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(childEnv) != "" {
+		if err := runChild(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runChild receives a conn through the unix socket at fd 3, resumes it and
+// echoes data until the client closes it
+func runChild() error {
+	cert, err := tls.X509KeyPair([]byte(os.Getenv(childCertEnv)), []byte(os.Getenv(childKeyEnv)))
+	if err != nil {
+		return err
+	}
+	uc, err := unixConn(os.NewFile(3, "handoff"))
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+
+	conn, state, err := handoff.Receive(uc)
+	if err != nil {
+		return err
+	}
+	if _, _, err := handoff.Receive(uc); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("expected EOF, got %v", err)
+	}
+	c, err := resumetls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}}, state)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = io.Copy(c, c)
+	return err
+}
+
+// unixConn returns a unix conn from a file, which is closed
+func unixConn(f *os.File) (*net.UnixConn, error) {
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		_ = conn.Close()
+		return nil, fmt.Errorf("unexpected conn type %T", conn)
+	}
+	return uc, nil
+}
+
+// newCertificate generates a self signed certificate in PEM format
+func newCertificate(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+}
+
+func TestHandoff(t *testing.T) {
+	certPEM, keyPEM := newCertificate(t)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	defer client.Close()
+	raw, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	// Handshake and exchange data with the parent process
+	server, err := resumetls.Server(raw, &tls.Config{Certificates: []tls.Certificate{cert}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshakeErr := make(chan error, 1)
+	go func() { handshakeErr <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-handshakeErr; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	recv := make([]byte, 5)
+	if _, err := io.ReadFull(server, recv); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write(recv); err != nil {
+		t.Fatal(err)
+	}
+	readEcho(t, client, "hello")
+
+	// Data sent before the handoff is delivered by the child
+	if _, err := client.Write([]byte("in flight")); err != nil {
+		t.Fatal(err)
+	}
+	state, err := server.Pause(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Launch the child with one end of a unix socket pair
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childFile := os.NewFile(uintptr(fds[1]), "child")
+	uc, err := unixConn(os.NewFile(uintptr(fds[0]), "parent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	var stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(),
+		childEnv+"=1",
+		childCertEnv+"="+string(certPEM),
+		childKeyEnv+"="+string(keyPEM),
+	)
+	cmd.ExtraFiles = []*os.File{childFile}
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = cmd.Process.Kill() }()
+	_ = childFile.Close()
+
+	if err := handoff.Send(uc, raw, state); err != nil {
+		t.Fatal(err)
+	}
+	// The parent copy of the socket is closed without affecting the child
+	_ = raw.Close()
+	_ = uc.Close()
+
+	readEcho(t, client, "in flight")
+	for _, msg := range []string{"handed off", "still here"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		readEcho(t, client, msg)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("child failed: %v\n%s", err, stderr.String())
+	}
+}
+
+// readEcho reads a message echoed by the server
+func readEcho(t *testing.T, c *tls.Conn, want string) {
+	t.Helper()
+	if err := c.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	recv := make([]byte, len(want))
+	if _, err := io.ReadFull(c, recv); err != nil {
+		t.Fatal(err)
+	}
+	if string(recv) != want {
+		t.Fatalf("unexpected echo %q, want %q", recv, want)
+	}
+}
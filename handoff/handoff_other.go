@@ -0,0 +1,24 @@
+//go:build !linux
+
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/igolaizola/resumetls"
+)
+
+// errUnsupported is returned on platforms other than Linux
+var errUnsupported = fmt.Errorf("handoff: %w on this platform", errors.ErrUnsupported)
+
+// Send is only supported on Linux
+func Send(uc *net.UnixConn, conn net.Conn, state *resumetls.State) error {
+	return errUnsupported
+}
+
+// Receive is only supported on Linux
+func Receive(uc *net.UnixConn) (net.Conn, *resumetls.State, error) {
+	return nil, nil, errUnsupported
+}
@@ -0,0 +1,179 @@
+package resumetls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// pausedClient performs a handshake and an echo with a tls server and returns
+// the client state along with the client side of the pipe
+func pausedClient(t *testing.T, ciphers []uint16) (*State, net.Conn) {
+	t.Helper()
+	sConn, cConn := net.Pipe()
+
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := tls.Server(sConn, &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		CipherSuites: ciphers,
+	})
+	go func() {
+		defer srv.Close()
+		recv := make([]byte, 1024)
+		for {
+			n, err := srv.Read(recv)
+			if err != nil {
+				return
+			}
+			if _, err := srv.Write(recv[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	cli, err := Client(cConn, &tls.Config{
+		InsecureSkipVerify: true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, cli)
+	return cli.State(), cConn
+}
+
+// echo writes a message and checks it is read back from an echo peer
+func echo(t *testing.T, c net.Conn) {
+	t.Helper()
+	transfer(t, c, c, "Hello")
+}
+
+// transfer writes a message on one conn and checks it is read on the other
+func transfer(t *testing.T, w, r net.Conn, message string) {
+	t.Helper()
+	if _, err := w.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	recv := make([]byte, 1024)
+	n, err := r.Read(recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recv[:n]) != message {
+		t.Fatalf("messages missmatch: %s != %s", message, recv[:n])
+	}
+}
+
+// handshakedConn performs a handshake and an echo between a resumable conn
+// created with opts and a tls echo peer and returns the resumable conn along
+// with its side of the pipe
+func handshakedConn(t *testing.T, client bool, cfg, peerCfg *tls.Config, opts ...Option) (*Conn, net.Conn) {
+	t.Helper()
+	peerConn, conn := net.Pipe()
+	t.Cleanup(func() { _ = conn.Close() })
+
+	newConn := Server
+	peer := tls.Client(peerConn, peerCfg)
+	if client {
+		newConn = Client
+		peer = tls.Server(peerConn, peerCfg)
+	}
+	go func() {
+		defer peer.Close()
+		recv := make([]byte, 1024)
+		for {
+			n, err := peer.Read(recv)
+			if err != nil {
+				return
+			}
+			if _, err := peer.Write(recv[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := newConn(conn, cfg, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c)
+	return c, conn
+}
+
+// resumablePair performs a handshake between a resumable client created with
+// opts and a resumable server over tcp and returns both conns along with their
+// network connections, which fail after 5 seconds instead of hanging
+func resumablePair(t *testing.T, cliCfg, srvCfg *tls.Config, opts ...Option) (*Conn, *Conn, net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cConn.Close() })
+	sConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sConn.Close() })
+	_ = cConn.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = sConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	cli, err := Client(cConn, cliCfg, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := Server(sConn, srvCfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.Handshake()
+	}()
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	return cli, srv, cConn, sConn
+}
+
+// newCertificate generates a self signed certificate
+func newCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
@@ -18,3 +18,9 @@ func FieldToInterface(p reflect.Value, name string) interface{} {
 	field = reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
 	return field.Interface()
 }
+
+// FieldPointer gets a pointer to a field of the given reflected value
+func FieldPointer(p reflect.Value, name string) unsafe.Pointer {
+	field := p.FieldByName(name)
+	return unsafe.Pointer(field.UnsafeAddr())
+}
@@ -0,0 +1,55 @@
+package suite
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ExpandLabel implements HKDF-Expand-Label from RFC 8446, Section 7.1
+func ExpandLabel(h crypto.Hash, secret []byte, label string, context []byte, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 2+1+len(label)+1+len(context))
+	info = append(info, byte(length>>8), byte(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, byte(len(context)))
+	info = append(info, context...)
+	out := make([]byte, length)
+	// Reading less than 255 hash sizes from HKDF-Expand doesn't fail
+	if _, err := io.ReadFull(hkdf.Expand(h.New, secret, info), out); err != nil {
+		panic("suite: hkdf expand failed: " + err.Error())
+	}
+	return out
+}
+
+// NextTrafficSecret derives the next application traffic secret after a key
+// update as described in RFC 8446, Section 7.2
+func NextTrafficSecret(h crypto.Hash, secret []byte) []byte {
+	return ExpandLabel(h, secret, "traffic upd", nil, h.Size())
+}
+
+// PRF implements the TLS 1.2 pseudo random function from RFC 5246, Section 5
+func PRF(h crypto.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelAndSeed := make([]byte, 0, len(label)+len(seed))
+	labelAndSeed = append(labelAndSeed, label...)
+	labelAndSeed = append(labelAndSeed, seed...)
+
+	out := make([]byte, 0, length+h.Size())
+	mac := hmac.New(h.New, secret)
+	mac.Write(labelAndSeed)
+	a := mac.Sum(nil)
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelAndSeed)
+		out = mac.Sum(out)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:length:length]
+}
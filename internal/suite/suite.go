@@ -0,0 +1,221 @@
+package suite
+
+import (
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	// Required to register hash functions
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Kind is the kind of record protection used by a cipher suite
+type Kind int
+
+const (
+	// AESGCM is AES-GCM
+	AESGCM Kind = iota + 1
+	// ChaCha20Poly1305 is ChaCha20-Poly1305
+	ChaCha20Poly1305
+	// AESCBC is AES-CBC with HMAC
+	AESCBC
+	// TripleDESCBC is 3DES-EDE-CBC with HMAC
+	TripleDESCBC
+)
+
+// Suite contains the parameters of a cipher suite needed to protect records
+type Suite struct {
+	ID     uint16
+	Kind   Kind
+	KeyLen int
+	// IVLen is the fixed IV length derived from the key schedule
+	IVLen int
+	// MAC is the HMAC hash for CBC suites
+	MAC crypto.Hash
+	// Hash is the PRF hash in TLS 1.2 and the HKDF hash in TLS 1.3
+	Hash crypto.Hash
+}
+
+// MACLen returns the length of the MAC key
+func (s *Suite) MACLen() int {
+	if s.MAC == 0 {
+		return 0
+	}
+	return s.MAC.Size()
+}
+
+// suitesTLS13 are the supported TLS 1.3 cipher suites
+var suitesTLS13 = map[uint16]*Suite{
+	tls.TLS_AES_128_GCM_SHA256:       {tls.TLS_AES_128_GCM_SHA256, AESGCM, 16, 12, 0, crypto.SHA256},
+	tls.TLS_AES_256_GCM_SHA384:       {tls.TLS_AES_256_GCM_SHA384, AESGCM, 32, 12, 0, crypto.SHA384},
+	tls.TLS_CHACHA20_POLY1305_SHA256: {tls.TLS_CHACHA20_POLY1305_SHA256, ChaCha20Poly1305, 32, 12, 0, crypto.SHA256},
+}
+
+// suitesTLS12 are the supported TLS 1.2 cipher suites
+var suitesTLS12 = map[uint16]*Suite{
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:                 {tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA, TripleDESCBC, 24, 8, crypto.SHA1, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:                  {tls.TLS_RSA_WITH_AES_128_CBC_SHA, AESCBC, 16, 16, crypto.SHA1, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:                  {tls.TLS_RSA_WITH_AES_256_CBC_SHA, AESCBC, 32, 16, crypto.SHA1, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:               {tls.TLS_RSA_WITH_AES_128_CBC_SHA256, AESCBC, 16, 16, crypto.SHA256, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               {tls.TLS_RSA_WITH_AES_128_GCM_SHA256, AESGCM, 16, 4, 0, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               {tls.TLS_RSA_WITH_AES_256_GCM_SHA384, AESGCM, 32, 4, 0, crypto.SHA384},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          {tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA, AESCBC, 16, 16, crypto.SHA1, crypto.SHA256},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          {tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA, AESCBC, 32, 16, crypto.SHA1, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:           {tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA, TripleDESCBC, 24, 8, crypto.SHA1, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:            {tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, AESCBC, 16, 16, crypto.SHA1, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:            {tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA, AESCBC, 32, 16, crypto.SHA1, crypto.SHA256},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:       {tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256, AESCBC, 16, 16, crypto.SHA256, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:         {tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256, AESCBC, 16, 16, crypto.SHA256, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         {tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, AESGCM, 16, 4, 0, crypto.SHA256},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       {tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, AESGCM, 16, 4, 0, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         {tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, AESGCM, 32, 4, 0, crypto.SHA384},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       {tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, AESGCM, 32, 4, 0, crypto.SHA384},
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   {tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, ChaCha20Poly1305, 32, 12, 0, crypto.SHA256},
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: {tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, ChaCha20Poly1305, 32, 12, 0, crypto.SHA256},
+}
+
+// Lookup returns the suite parameters for a TLS version and cipher suite.
+// Only TLS 1.2 and TLS 1.3 are supported.
+func Lookup(version, id uint16) (*Suite, error) {
+	var s *Suite
+	switch version {
+	case tls.VersionTLS13:
+		s = suitesTLS13[id]
+	case tls.VersionTLS12:
+		s = suitesTLS12[id]
+	default:
+		return nil, fmt.Errorf("unsupported tls version %s", tls.VersionName(version))
+	}
+	if s == nil {
+		return nil, fmt.Errorf("unsupported cipher suite %s for %s", tls.CipherSuiteName(id), tls.VersionName(version))
+	}
+	return s, nil
+}
+
+// Keys is the key material used to protect records in one direction
+type Keys struct {
+	Key []byte
+	IV  []byte
+	MAC []byte
+}
+
+// KeysFromTrafficSecret derives TLS 1.3 record keys from a traffic secret as
+// described in RFC 8446, Section 7.3
+func (s *Suite) KeysFromTrafficSecret(secret []byte) Keys {
+	return Keys{
+		Key: ExpandLabel(s.Hash, secret, "key", nil, s.KeyLen),
+		IV:  ExpandLabel(s.Hash, secret, "iv", nil, s.IVLen),
+	}
+}
+
+// KeysFromMasterSecret derives TLS 1.2 client and server record keys from the
+// master secret as described in RFC 5246, Section 6.3
+func (s *Suite) KeysFromMasterSecret(masterSecret, clientRandom, serverRandom []byte) (client, server Keys) {
+	seed := make([]byte, 0, len(serverRandom)+len(clientRandom))
+	seed = append(seed, serverRandom...)
+	seed = append(seed, clientRandom...)
+
+	macLen := s.MACLen()
+	n := 2*macLen + 2*s.KeyLen + 2*s.IVLen
+	material := PRF(s.Hash, masterSecret, "key expansion", seed, n)
+	next := func(n int) []byte {
+		b := material[:n:n]
+		material = material[n:]
+		return b
+	}
+	client.MAC = next(macLen)
+	server.MAC = next(macLen)
+	client.Key = next(s.KeyLen)
+	server.Key = next(s.KeyLen)
+	client.IV = next(s.IVLen)
+	server.IV = next(s.IVLen)
+	return client, server
+}
+
+const (
+	recordHeaderLen     = 5
+	recordTypeHandshake = 22
+)
+
+// Handshake message types
+const (
+	TypeClientHello byte = 1
+	TypeServerHello byte = 2
+)
+
+// handshakeMessages calls fn with the type and body of each handshake message
+// found in a stream of plaintext TLS records until fn returns false
+func handshakeMessages(records []byte, fn func(typ byte, body []byte) bool) {
+	var hs []byte
+	for len(records) >= recordHeaderLen {
+		n := int(records[3])<<8 | int(records[4])
+		if len(records) < recordHeaderLen+n {
+			return
+		}
+		if records[0] == recordTypeHandshake {
+			hs = append(hs, records[recordHeaderLen:recordHeaderLen+n]...)
+		}
+		records = records[recordHeaderLen+n:]
+
+		for len(hs) >= 4 {
+			msgLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+			if len(hs) < 4+msgLen {
+				break
+			}
+			if !fn(hs[0], hs[4:4+msgLen]) {
+				return
+			}
+			hs = hs[4+msgLen:]
+		}
+	}
+}
+
+// ServerRandom returns the random of the first ServerHello found in a stream
+// of plaintext TLS records
+func ServerRandom(records []byte) ([]byte, error) {
+	return helloRandom(records, TypeServerHello)
+}
+
+// ClientRandom returns the random of the first ClientHello found in a stream
+// of plaintext TLS records
+func ClientRandom(records []byte) ([]byte, error) {
+	return helloRandom(records, TypeClientHello)
+}
+
+// helloRandom returns the random of the first hello message of the given type
+func helloRandom(records []byte, helloType byte) ([]byte, error) {
+	var random []byte
+	handshakeMessages(records, func(typ byte, body []byte) bool {
+		// Hello bodies start with the version followed by the random
+		if typ == helloType && len(body) >= 2+32 {
+			random = append([]byte{}, body[2:2+32]...)
+			return false
+		}
+		return true
+	})
+	if random == nil {
+		if helloType == TypeClientHello {
+			return nil, errors.New("client hello not found")
+		}
+		return nil, errors.New("server hello not found")
+	}
+	return random, nil
+}
+
+// FirstHandshakeType returns the type of the first handshake message found in
+// a stream of plaintext TLS records
+func FirstHandshakeType(records []byte) (byte, error) {
+	var first byte
+	var found bool
+	handshakeMessages(records, func(typ byte, _ []byte) bool {
+		first, found = typ, true
+		return false
+	})
+	if !found {
+		return 0, errors.New("handshake message not found")
+	}
+	return first, nil
+}
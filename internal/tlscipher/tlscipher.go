@@ -0,0 +1,197 @@
+package tlscipher
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+	_ "unsafe" // Required by go:linkname
+
+	intref "github.com/igolaizola/resumetls/internal/reflect"
+	"github.com/igolaizola/resumetls/internal/suite"
+)
+
+// cipherSuiteTLS13 mirrors the layout of crypto/tls.cipherSuiteTLS13.
+// The aead function returns crypto/tls.aead, an interface whose first methods
+// match cipher.AEAD.
+type cipherSuiteTLS13 struct {
+	id     uint16
+	keyLen int
+	aead   func(key, fixedNonce []byte) cipher.AEAD
+	hash   crypto.Hash
+}
+
+// cipherSuitesTLS13 is exposed by crypto/tls for linkname access.
+// See https://go.dev/issue/67401
+//
+//go:linkname cipherSuitesTLS13 crypto/tls.cipherSuitesTLS13
+var cipherSuitesTLS13 []*cipherSuiteTLS13
+
+// CheckRuntime checks that the crypto/tls internals accessed by this package
+// match the expected layout. The TLS 1.3 cipher suites can't be inspected
+// using reflection, so their values are checked instead.
+func CheckRuntime() error {
+	if len(cipherSuitesTLS13) == 0 {
+		return errors.New("tls 1.3 cipher suites not found")
+	}
+	for _, cs := range cipherSuitesTLS13 {
+		if cs == nil {
+			return errors.New("unexpected tls 1.3 cipher suite layout")
+		}
+		s, err := suite.Lookup(tls.VersionTLS13, cs.id)
+		if err != nil || cs.aead == nil || cs.keyLen != s.KeyLen || cs.hash != s.Hash {
+			return errors.New("unexpected tls 1.3 cipher suite layout")
+		}
+	}
+	return nil
+}
+
+// New returns a cipher and mac using the same concrete types that crypto/tls
+// uses internally, so they can be set on its record layer.
+// The read parameter selects between decryption and encryption for CBC
+// suites.
+func New(s *suite.Suite, version uint16, keys suite.Keys, read bool) (any, hash.Hash, error) {
+	if len(keys.Key) != s.KeyLen || len(keys.IV) != s.IVLen || len(keys.MAC) != s.MACLen() {
+		return nil, nil, errors.New("invalid key material length")
+	}
+	switch s.Kind {
+	case suite.AESGCM:
+		if version == tls.VersionTLS13 {
+			return xorNonceAEAD(s.ID, keys)
+		}
+		return prefixNonceAEAD(keys)
+	case suite.ChaCha20Poly1305:
+		// TLS 1.2 and TLS 1.3 use the same nonce construction
+		return xorNonceAEAD(tls.TLS_CHACHA20_POLY1305_SHA256, keys)
+	case suite.AESCBC, suite.TripleDESCBC:
+		var block cipher.Block
+		var err error
+		if s.Kind == suite.AESCBC {
+			block, err = aes.NewCipher(keys.Key)
+		} else {
+			block, err = des.NewTripleDESCipher(keys.Key)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		mac := hmac.New(s.MAC.New, keys.MAC)
+		if read {
+			return cipher.NewCBCDecrypter(block, keys.IV), mac, nil
+		}
+		return cipher.NewCBCEncrypter(block, keys.IV), mac, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported cipher suite %s", tls.CipherSuiteName(s.ID))
+	}
+}
+
+// xorNonceAEAD returns a crypto/tls.xorNonceAEAD using the constructor
+// registered by crypto/tls for the given TLS 1.3 suite
+func xorNonceAEAD(id uint16, keys suite.Keys) (any, hash.Hash, error) {
+	for _, cs := range cipherSuitesTLS13 {
+		if cs.id == id {
+			return cs.aead(keys.Key, keys.IV), nil, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("cipher suite %s not found", tls.CipherSuiteName(id))
+}
+
+// prefixNonceAEAD returns a crypto/tls.prefixNonceAEAD
+func prefixNonceAEAD(keys suite.Keys) (any, hash.Hash, error) {
+	typ, err := prefixNonceType()
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(keys.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	var nonce [12]byte
+	copy(nonce[:], keys.IV)
+
+	v := reflect.New(typ.Elem())
+	intref.SetFieldValue(v.Elem(), "nonce", nonce)
+	intref.SetFieldValue(v.Elem(), "aead", gcm)
+	return v.Interface(), nil, nil
+}
+
+// prefixNonceType obtains the type of crypto/tls.prefixNonceAEAD, which isn't
+// reachable by linkname, from a TLS 1.2 AES-GCM handshake over a pipe
+var prefixNonceType = sync.OnceValues(func() (reflect.Type, error) {
+	cert, err := probeCertificate()
+	if err != nil {
+		return nil, err
+	}
+	sConn, cConn := net.Pipe()
+	defer sConn.Close()
+	defer cConn.Close()
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	srv := tls.Server(sConn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		CipherSuites: suites,
+		MaxVersion:   tls.VersionTLS12,
+	})
+	cli := tls.Client(cConn, &tls.Config{
+		InsecureSkipVerify: true,
+		CipherSuites:       suites,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.Handshake()
+	}()
+	if err := cli.Handshake(); err != nil {
+		return nil, fmt.Errorf("probe handshake failed: %w", err)
+	}
+	if err := <-errC; err != nil {
+		return nil, fmt.Errorf("probe handshake failed: %w", err)
+	}
+
+	out := reflect.ValueOf(cli).Elem().FieldByName("out")
+	typ := reflect.TypeOf(intref.FieldToInterface(out, "cipher"))
+	if typ == nil || typ.Kind() != reflect.Pointer || typ.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("unexpected tls 1.2 aead type %v", typ)
+	}
+	if f, ok := typ.Elem().FieldByName("nonce"); !ok || f.Type != reflect.TypeOf([12]byte{}) {
+		return nil, fmt.Errorf("unexpected tls 1.2 aead type %v", typ)
+	}
+	if f, ok := typ.Elem().FieldByName("aead"); !ok || f.Type != reflect.TypeOf((*cipher.AEAD)(nil)).Elem() {
+		return nil, fmt.Errorf("unexpected tls 1.2 aead type %v", typ)
+	}
+	return typ, nil
+})
+
+// probeCertificate generates a self signed certificate for probe handshakes
+func probeCertificate() (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
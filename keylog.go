@@ -0,0 +1,58 @@
+package resumetls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errNoKeyLog is returned when writing the key log of a state that doesn't
+// contain one
+var errNoKeyLog = errors.New("resumetls: state doesn't contain a key log")
+
+// keyLogClientRandom is the key log label of TLS 1.2 master secrets
+const keyLogClientRandom = "CLIENT_RANDOM"
+
+// WriteKeyLog writes the key log of the handshake that established the
+// connection in NSS key log format, as crypto/tls writes it to
+// tls.Config.KeyLogWriter. It allows tools like Wireshark to decrypt traffic
+// captured before and after resuming, since resumed connections don't write
+// the key log again.
+// Compact states don't contain the key log.
+func (s *State) WriteKeyLog(w io.Writer) error {
+	if len(s.keyLog) == 0 {
+		return errNoKeyLog
+	}
+	_, err := w.Write(s.keyLog)
+	return err
+}
+
+// appendKeyLog appends an NSS key log line
+func appendKeyLog(keyLog []byte, label string, clientRandom, secret []byte) []byte {
+	return fmt.Appendf(keyLog, "%s %x %x\n", label, clientRandom, secret)
+}
+
+// checkKeyLog checks that every line of the key log contains a label and two
+// hex values
+func checkKeyLog(keyLog []byte) error {
+	if len(keyLog) > 0 && keyLog[len(keyLog)-1] != '\n' {
+		return errors.New("missing trailing newline")
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(keyLog))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), " ")
+		if len(fields) != 3 || fields[0] == "" {
+			return fmt.Errorf("invalid line %q", scanner.Text())
+		}
+		for _, field := range fields[1:] {
+			if _, err := hex.DecodeString(field); err != nil || field == "" {
+				return fmt.Errorf("invalid line %q", scanner.Text())
+			}
+		}
+	}
+	return scanner.Err()
+}
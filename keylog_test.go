@@ -0,0 +1,117 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestKeyLog(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		t.Run(tls.VersionName(version), func(t *testing.T) {
+			testKeyLog(t, version)
+		})
+	}
+}
+
+func testKeyLog(t *testing.T, version uint16) {
+	pair := newCertificate(t)
+	var logged, peerLogged bytes.Buffer
+	cliCfg := func(keyLog *bytes.Buffer, cache tls.ClientSessionCache) *tls.Config {
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "localhost",
+			MinVersion:         version,
+			MaxVersion:         version,
+			ClientSessionCache: cache,
+			KeyLogWriter:       keyLog,
+		}
+	}
+	srvCfg := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		KeyLogWriter: &peerLogged,
+	}
+	keyLog := func(s *State) string {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := s.WriteKeyLog(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	cache := tls.NewLRUClientSessionCache(8)
+	c, conn := handshakedConn(t, true, cliCfg(&logged, cache), srvCfg)
+	s := c.State()
+	got := keyLog(s)
+	if got != logged.String() {
+		t.Fatalf("key log mismatch:\n%s\nwant:\n%s", got, logged.String())
+	}
+	// Every line matches the one logged by the peer
+	for _, line := range strings.SplitAfter(got, "\n") {
+		if !strings.Contains(peerLogged.String(), line) {
+			t.Fatalf("key log line %q not logged by the peer", line)
+		}
+	}
+
+	// Compact states don't contain the key log
+	compact, err := c.CompactState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compact.WriteKeyLog(&bytes.Buffer{}); err == nil {
+		t.Fatal("expected missing key log error")
+	}
+
+	// Resuming doesn't write the key log again, the state keeps it
+	var resumedLogged bytes.Buffer
+	resumed, err := Client(conn, cliCfg(&resumedLogged, tls.NewLRUClientSessionCache(8)), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, resumed)
+	if resumedLogged.Len() > 0 {
+		t.Fatalf("resumed conn wrote key log:\n%s", resumedLogged.String())
+	}
+	if resumedLog := keyLog(resumed.State()); resumedLog != got {
+		t.Fatalf("resumed key log mismatch:\n%s\nwant:\n%s", resumedLog, got)
+	}
+
+	// TLS 1.2 abbreviated handshakes don't log the master secret, which is
+	// the one of the resumed session
+	logged.Reset()
+	c, _ = handshakedConn(t, true, cliCfg(&logged, cache), srvCfg)
+	if !c.ConnectionState().DidResume {
+		t.Fatal("session wasn't resumed")
+	}
+	got = keyLog(c.State())
+	if version == tls.VersionTLS12 {
+		_, masterSecret, err := parseKeyLog([]byte(keyLog(s)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, resumedSecret, err := parseKeyLog([]byte(got))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(masterSecret, resumedSecret) {
+			t.Fatal("master secret of the resumed session not logged")
+		}
+	} else if got != logged.String() {
+		t.Fatalf("key log mismatch:\n%s\nwant:\n%s", got, logged.String())
+	}
+
+	// Key logs are kept when encoding states
+	var decoded State
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if keyLog(&decoded) != keyLog(s) {
+		t.Fatal("key log not encoded")
+	}
+}
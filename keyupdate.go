@@ -0,0 +1,33 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"reflect"
+
+	intref "github.com/igolaizola/resumetls/internal/reflect"
+	"github.com/igolaizola/resumetls/internal/suite"
+	"github.com/igolaizola/resumetls/internal/tlscipher"
+)
+
+// setTrafficSecret sets the TLS 1.3 traffic secret of a half conn along with
+// the record cipher derived from it and resets its sequence number
+func setTrafficSecret(half reflect.Value, s *suite.Suite, secret []byte, read bool) error {
+	aead, _, err := tlscipher.New(s, tls.VersionTLS13, s.KeysFromTrafficSecret(secret), read)
+	if err != nil {
+		return err
+	}
+	intref.SetFieldValue(half, "trafficSecret", secret)
+	intref.SetFieldValue(half, "cipher", aead)
+	intref.SetFieldValue(half, "seq", [8]byte{})
+	return nil
+}
+
+// setTrafficSecrets sets the TLS 1.3 traffic secrets of both directions,
+// sequence numbers must be set afterwards
+func setTrafficSecrets(conn *tls.Conn, s *suite.Suite, in, out []byte) error {
+	r := reflect.ValueOf(conn).Elem()
+	if err := setTrafficSecret(r.FieldByName("in"), s, in, true); err != nil {
+		return err
+	}
+	return setTrafficSecret(r.FieldByName("out"), s, out, false)
+}
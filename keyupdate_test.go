@@ -0,0 +1,176 @@
+package resumetls
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	intref "github.com/igolaizola/resumetls/internal/reflect"
+	"github.com/igolaizola/resumetls/internal/suite"
+)
+
+func TestKeyUpdate(t *testing.T) {
+	t.Run("State", func(t *testing.T) {
+		testKeyUpdate(t, false)
+	})
+	t.Run("CompactState", func(t *testing.T) {
+		testKeyUpdate(t, true)
+	})
+}
+
+func testKeyUpdate(t *testing.T, compact bool) {
+	cliCfg := &tls.Config{InsecureSkipVerify: true}
+	srvCfg := &tls.Config{Certificates: []tls.Certificate{newCertificate(t)}}
+	cli, srv, cConn, sConn := resumablePair(t, cliCfg, srvCfg)
+	if v := cli.ConnectionState().Version; v != tls.VersionTLS13 {
+		t.Fatalf("unexpected version %s", tls.VersionName(v))
+	}
+	exchange(t, cli, srv, true)
+	exchange(t, cli, srv, true)
+
+	pause := func(c *Conn, role Role) *Conn {
+		t.Helper()
+		state, err := c.Pause(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compact {
+			if state, err = c.CompactState(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := state.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded State
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		var resumed *Conn
+		if role == RoleClient {
+			resumed, err = Client(cConn, cliCfg, &decoded)
+		} else {
+			resumed, err = Server(sConn, srvCfg, &decoded)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resumed
+	}
+	// Each side is resumed while the other one keeps the updated keys
+	cli2 := pause(cli, RoleClient)
+	transfer(t, cli2, srv, "resumed")
+	transfer(t, srv, cli2, "resumed")
+	exchange(t, cli2, srv, true)
+
+	srv2 := pause(srv, RoleServer)
+	transfer(t, cli2, srv2, "resumed")
+	transfer(t, srv2, cli2, "resumed")
+	exchange(t, cli2, srv2, true)
+
+	// Key updates aren't available before TLS 1.3
+	c, _ := handshakedConn(t, true, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	}, srvCfg)
+	if err := updateKey(c, false); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// exchange sends a message in each direction, updating the keys of the
+// sender first if requested
+func exchange(t *testing.T, cli, srv *Conn, updateKeys bool) {
+	t.Helper()
+	if updateKeys {
+		if err := updateKey(cli, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transfer(t, cli, srv, "ping")
+	if updateKeys {
+		if err := updateKey(srv, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transfer(t, srv, cli, "pong")
+}
+
+const (
+	recordTypeHandshake       = 22
+	recordTypeApplicationData = 23
+	typeKeyUpdate             = 24
+)
+
+// updateKey sends a TLS 1.3 KeyUpdate message and rotates the write traffic
+// secret as described in RFC 8446, Section 4.6.3, crypto/tls only sends them
+// in response to the peer's ones.
+// If requestPeer is true the peer is requested to rotate its write traffic
+// secret too, which happens when it reads the message.
+func updateKey(c *Conn, requestPeer bool) error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if err := c.gate.enter(&c.gate.writes); err != nil {
+		return err
+	}
+	defer c.gate.exitWrite()
+
+	if v := getVersion(c.Conn); v != tls.VersionTLS13 {
+		return fmt.Errorf("resumetls: key update not supported in %s", tls.VersionName(v))
+	}
+	_, _, cipherSuite := getState(c.Conn)
+	s, err := suite.Lookup(tls.VersionTLS13, cipherSuite)
+	if err != nil {
+		return fmt.Errorf("resumetls: key update not supported: %w", err)
+	}
+
+	r := reflect.ValueOf(c.Conn).Elem()
+	out := r.FieldByName("out")
+	mu := halfMutex(c.Conn, "out")
+	mu.Lock()
+	defer mu.Unlock()
+
+	aead, ok := intref.FieldToInterface(out, "cipher").(cipher.AEAD)
+	if !ok {
+		return errors.New("resumetls: key update not supported: unexpected cipher")
+	}
+	seq, secret := getSeq(c.Conn, "out"), getTrafficSecret(c.Conn, "out")
+
+	// The inner plaintext is the key update message followed by its content
+	// type, the record is sent as application data
+	var requested byte
+	if requestPeer {
+		requested = 1
+	}
+	plaintext := []byte{typeKeyUpdate, 0, 0, 1, requested, recordTypeHandshake}
+	n := len(plaintext) + aead.Overhead()
+	header := []byte{recordTypeApplicationData, 3, 3, byte(n >> 8), byte(n)}
+	record := aead.Seal(header, seq[:], plaintext, header)
+	// The sequence number is consumed before writing the record, as
+	// crypto/tls does, so the write-ahead log doesn't report it as unused
+	intref.SetFieldValue(out, "seq", nextSeq(seq))
+
+	conn := intref.FieldToInterface(r, "conn").(net.Conn)
+	if _, err := conn.Write(record); err != nil {
+		return err
+	}
+	if err := setTrafficSecret(out, s, suite.NextTrafficSecret(s.Hash, secret), false); err != nil {
+		return err
+	}
+	return c.wal.logOut()
+}
+
+// nextSeq returns the sequence number following seq
+func nextSeq(seq [8]byte) [8]byte {
+	var next [8]byte
+	binary.BigEndian.PutUint64(next[:], binary.BigEndian.Uint64(seq[:])+1)
+	return next
+}
@@ -0,0 +1,94 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/igolaizola/resumetls/internal/suite"
+)
+
+// Linux kTLS cipher types from include/uapi/linux/tls.h
+const (
+	ktlsCipherAESGCM128        = 51
+	ktlsCipherAESGCM256        = 52
+	ktlsCipherChaCha20Poly1305 = 54
+)
+
+// errKTLSBuffered is returned when exporting kTLS crypto info of a conn with
+// received data that hasn't been read, which the kernel wouldn't deliver
+var errKTLSBuffered = errors.New("resumetls: kTLS export not possible with buffered input")
+
+// KTLSCryptoInfo returns the current keys and record sequence numbers of both
+// directions using the tls12_crypto_info_* layouts of Linux kTLS, to be set
+// on the socket with setsockopt(SOL_TLS, TLS_TX, tx) and
+// setsockopt(SOL_TLS, TLS_RX, rx).
+// The conn must not be used afterwards, so it should be paused first.
+func (c *Conn) KTLSCryptoInfo() (tx, rx []byte, err error) {
+	state, err := c.CompactState()
+	if err != nil {
+		return nil, nil, err
+	}
+	return state.KTLSCryptoInfo()
+}
+
+// KTLSCryptoInfo returns the keys and record sequence numbers of both
+// directions of a compact state using the tls12_crypto_info_* layouts of
+// Linux kTLS.
+// Only AES-GCM and ChaCha20-Poly1305 cipher suites are supported and the
+// state can't contain buffered input.
+func (s *State) KTLSCryptoInfo() (tx, rx []byte, err error) {
+	if !s.compact() {
+		return nil, nil, errNotCompact
+	}
+	if s.Buffered() > 0 {
+		return nil, nil, errKTLSBuffered
+	}
+	if tx, err = ktlsCryptoInfo(s.version, s.cipherSuite, s.outKeys, s.outSeq); err != nil {
+		return nil, nil, err
+	}
+	if rx, err = ktlsCryptoInfo(s.version, s.cipherSuite, s.inKeys, s.inSeq); err != nil {
+		return nil, nil, err
+	}
+	return tx, rx, nil
+}
+
+// ktlsCryptoInfo encodes the crypto info of one direction. The layout is
+// the tls_crypto_info header (version and cipher type in host byte order)
+// followed by the iv, key, salt and rec_seq arrays.
+func ktlsCryptoInfo(version, id uint16, keys suite.Keys, seq [8]byte) ([]byte, error) {
+	s, err := suite.Lookup(version, id)
+	if err != nil {
+		return nil, fmt.Errorf("resumetls: kTLS export not supported: %w", err)
+	}
+	var cipherType uint16
+	var iv, salt []byte
+	switch {
+	case s.Kind == suite.AESGCM && version == tls.VersionTLS13:
+		// The nonce is the salt and iv xored with the sequence number
+		salt, iv = keys.IV[:4], keys.IV[4:]
+	case s.Kind == suite.AESGCM:
+		// TLS 1.2 explicit nonces are the sequence numbers
+		salt, iv = keys.IV, seq[:]
+	case s.Kind == suite.ChaCha20Poly1305:
+		iv = keys.IV
+		cipherType = ktlsCipherChaCha20Poly1305
+	default:
+		return nil, fmt.Errorf("resumetls: kTLS export not supported for %s", tls.CipherSuiteName(id))
+	}
+	if s.Kind == suite.AESGCM {
+		cipherType = ktlsCipherAESGCM128
+		if s.KeyLen == 32 {
+			cipherType = ktlsCipherAESGCM256
+		}
+	}
+
+	b := make([]byte, 0, 4+len(iv)+len(keys.Key)+len(salt)+len(seq))
+	b = binary.NativeEndian.AppendUint16(b, version)
+	b = binary.NativeEndian.AppendUint16(b, cipherType)
+	b = append(b, iv...)
+	b = append(b, keys.Key...)
+	b = append(b, salt...)
+	return append(b, seq[:]...), nil
+}
@@ -0,0 +1,230 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ktlsRef is a reference record encryptor that uses kTLS crypto info as the
+// kernel does
+type ktlsRef struct {
+	version uint16
+	iv      []byte
+	salt    []byte
+	seq     uint64
+	aead    cipher.AEAD
+	xor     bool
+}
+
+// parseKTLS parses kTLS crypto info using the sizes of include/uapi/linux/tls.h
+func parseKTLS(t *testing.T, b []byte, wantVersion uint16) *ktlsRef {
+	t.Helper()
+	version := binary.NativeEndian.Uint16(b[0:])
+	cipherType := binary.NativeEndian.Uint16(b[2:])
+	if version != wantVersion {
+		t.Fatalf("unexpected version %x", version)
+	}
+	var ivLen, keyLen, saltLen int
+	switch cipherType {
+	case ktlsCipherAESGCM128:
+		ivLen, keyLen, saltLen = 8, 16, 4
+	case ktlsCipherAESGCM256:
+		ivLen, keyLen, saltLen = 8, 32, 4
+	case ktlsCipherChaCha20Poly1305:
+		ivLen, keyLen, saltLen = 12, 32, 0
+	default:
+		t.Fatalf("unexpected cipher type %d", cipherType)
+	}
+	if want := 4 + ivLen + keyLen + saltLen + 8; len(b) != want {
+		t.Fatalf("unexpected crypto info length %d, want %d", len(b), want)
+	}
+	b = b[4:]
+	r := &ktlsRef{version: version}
+	r.iv, b = b[:ivLen], b[ivLen:]
+	key, b := b[:keyLen], b[keyLen:]
+	r.salt, b = b[:saltLen], b[saltLen:]
+	r.seq = binary.BigEndian.Uint64(b)
+
+	var err error
+	if cipherType == ktlsCipherChaCha20Poly1305 {
+		r.aead, err = chacha20poly1305.New(key)
+		r.xor = true
+	} else {
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err == nil {
+			r.aead, err = cipher.NewGCM(block)
+		}
+		r.xor = version == tls.VersionTLS13
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// nonce returns the salt and iv, xored with the sequence number in TLS 1.3
+// and ChaCha20-Poly1305
+func (r *ktlsRef) nonce(explicit []byte) []byte {
+	nonce := append(append([]byte{}, r.salt...), explicit...)
+	if r.xor {
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(r.seq >> (8 * i))
+		}
+	}
+	return nonce
+}
+
+// additionalData returns the TLS 1.2 additional data
+func (r *ktlsRef) additionalData(n int) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, r.seq)
+	return append(ad, 23, 3, 3, byte(n>>8), byte(n))
+}
+
+// seal returns an application data record
+func (r *ktlsRef) seal(data []byte) []byte {
+	defer func() { r.seq++ }()
+	switch {
+	case r.version == tls.VersionTLS13:
+		inner := append(append([]byte{}, data...), 23)
+		n := len(inner) + r.aead.Overhead()
+		hdr := []byte{23, 3, 3, byte(n >> 8), byte(n)}
+		return r.aead.Seal(hdr, r.nonce(r.iv), inner, hdr)
+	case r.xor:
+		n := len(data) + r.aead.Overhead()
+		hdr := []byte{23, 3, 3, byte(n >> 8), byte(n)}
+		return r.aead.Seal(hdr, r.nonce(r.iv), data, r.additionalData(len(data)))
+	default:
+		// The explicit nonce is the iv, which the kernel increments with
+		// every record
+		n := len(r.iv) + len(data) + r.aead.Overhead()
+		record := append([]byte{23, 3, 3, byte(n >> 8), byte(n)}, r.iv...)
+		record = r.aead.Seal(record, r.nonce(r.iv), data, r.additionalData(len(data)))
+		binary.BigEndian.PutUint64(r.iv, binary.BigEndian.Uint64(r.iv)+1)
+		return record
+	}
+}
+
+// open decrypts an application data record
+func (r *ktlsRef) open(t *testing.T, record []byte) []byte {
+	t.Helper()
+	defer func() { r.seq++ }()
+	hdr, payload := record[:5], record[5:]
+	var plaintext []byte
+	var err error
+	switch {
+	case r.version == tls.VersionTLS13:
+		plaintext, err = r.aead.Open(nil, r.nonce(r.iv), payload, hdr)
+		if err == nil {
+			plaintext = bytes.TrimRight(plaintext, "\x00")
+			plaintext = plaintext[:len(plaintext)-1]
+		}
+	case r.xor:
+		n := len(payload) - r.aead.Overhead()
+		plaintext, err = r.aead.Open(nil, r.nonce(r.iv), payload, r.additionalData(n))
+	default:
+		explicit, ciphertext := payload[:8], payload[8:]
+		n := len(ciphertext) - r.aead.Overhead()
+		plaintext, err = r.aead.Open(nil, r.nonce(explicit), ciphertext, r.additionalData(n))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plaintext
+}
+
+func TestKTLSCryptoInfo(t *testing.T) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		version uint16
+		ciphers []uint16
+	}{
+		{"TLS_AES_128_GCM_SHA256", tls.VersionTLS13, []uint16{tls.TLS_AES_128_GCM_SHA256}},
+		{"TLS_AES_256_GCM_SHA384", tls.VersionTLS13, []uint16{tls.TLS_AES_256_GCM_SHA384}},
+		{"TLS_CHACHA20_POLY1305_SHA256", tls.VersionTLS13, []uint16{tls.TLS_CHACHA20_POLY1305_SHA256}},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+		{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}},
+		{"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}},
+	}
+	for _, tt := range tests {
+		for _, client := range []bool{true, false} {
+			name := tt.name + "/Server"
+			if client {
+				name = tt.name + "/Client"
+			}
+			t.Run(name, func(t *testing.T) {
+				cliCfg := &tls.Config{
+					InsecureSkipVerify: true,
+					CipherSuites:       tt.ciphers,
+					MinVersion:         tt.version,
+					MaxVersion:         tt.version,
+				}
+				srvCfg := &tls.Config{
+					Certificates: []tls.Certificate{pair},
+					CipherSuites: tt.ciphers,
+					MinVersion:   tt.version,
+					MaxVersion:   tt.version,
+				}
+				var c *Conn
+				var conn net.Conn
+				if client {
+					c, conn = handshakedConn(t, true, cliCfg, srvCfg)
+				} else {
+					c, conn = handshakedConn(t, false, srvCfg, cliCfg)
+				}
+				tx, rx, err := c.KTLSCryptoInfo()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Records protected by the reference encryptor are echoed
+				// by the crypto/tls peer
+				refTX := parseKTLS(t, tx, tt.version)
+				refRX := parseKTLS(t, rx, tt.version)
+				for _, msg := range []string{"hello", "kernel"} {
+					if _, err := conn.Write(refTX.seal([]byte(msg))); err != nil {
+						t.Fatal(err)
+					}
+					hdr := make([]byte, 5)
+					if _, err := io.ReadFull(conn, hdr); err != nil {
+						t.Fatal(err)
+					}
+					record := make([]byte, 5+(int(hdr[3])<<8|int(hdr[4])))
+					copy(record, hdr)
+					if _, err := io.ReadFull(conn, record[5:]); err != nil {
+						t.Fatal(err)
+					}
+					if got := refRX.open(t, record); string(got) != msg {
+						t.Fatalf("unexpected echo %q", got)
+					}
+				}
+			})
+		}
+	}
+
+	t.Run("CBC", func(t *testing.T) {
+		ciphers := []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA256}
+		c, _ := handshakedConn(t, true, &tls.Config{
+			InsecureSkipVerify: true,
+			CipherSuites:       ciphers,
+			MaxVersion:         tls.VersionTLS12,
+		}, &tls.Config{
+			Certificates: []tls.Certificate{pair},
+			CipherSuites: ciphers,
+		})
+		if _, _, err := c.KTLSCryptoInfo(); err == nil {
+			t.Fatal("expected unsupported cipher suite error")
+		}
+	})
+}
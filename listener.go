@@ -0,0 +1,138 @@
+package resumetls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"sync"
+)
+
+// Listener is a net.Listener that accepts resumable server conns and keeps
+// track of them, so every active connection can be exported with Snapshot and
+// resumed by another listener, usually in a new process, with Restore.
+type Listener struct {
+	net.Listener
+	cfg   *tls.Config
+	opts  []Option
+	mu    sync.Mutex
+	conns map[*Conn]net.Conn
+}
+
+// ConnSnapshot contains an exported connection and the state needed to
+// resume it
+type ConnSnapshot struct {
+	// Conn is the network connection, its file descriptor can be passed to
+	// another process
+	Conn net.Conn
+	// State is the state of the paused resumable conn
+	State *State
+}
+
+// NewListener returns a listener that accepts connections from inner and
+// returns them as resumable server conns using cfg
+func NewListener(inner net.Listener, cfg *tls.Config, opts ...Option) *Listener {
+	return &Listener{
+		Listener: inner,
+		cfg:      cfg,
+		opts:     opts,
+		conns:    map[*Conn]net.Conn{},
+	}
+}
+
+// Accept waits for the next connection and returns it as a *Conn, which is
+// tracked until closed
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c, err := Server(conn, l.cfg, nil, l.opts...)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	l.track(c, conn)
+	return c, nil
+}
+
+// Snapshot pauses every tracked conn and returns their network connections
+// and states. Connections that haven't completed the handshake yet are closed
+// instead of waiting for their peers, which can connect again.
+// Exported conns are no longer tracked and become unusable, their reads and
+// writes return net.ErrClosed and closing them doesn't close the network
+// connection. If any conn can't be paused before the context is done, the
+// paused ones are unpaused and an error is returned.
+// The listener should be closed before taking a snapshot, since connections
+// accepted afterwards aren't included.
+func (l *Listener) Snapshot(ctx context.Context) ([]ConnSnapshot, error) {
+	l.mu.Lock()
+	conns := maps.Clone(l.conns)
+	l.mu.Unlock()
+
+	var snapshots []ConnSnapshot
+	var paused []*Conn
+	unpause := func() {
+		for _, c := range paused {
+			c.Unpause()
+		}
+	}
+	for c, conn := range conns {
+		state, err := c.Pause(ctx)
+		if errors.Is(err, net.ErrClosed) {
+			continue
+		}
+		if errors.Is(err, errHandshakeIncomplete) {
+			_ = c.Close()
+			continue
+		}
+		if err != nil {
+			unpause()
+			return nil, err
+		}
+		paused = append(paused, c)
+		snapshots = append(snapshots, ConnSnapshot{Conn: conn, State: state})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range paused {
+		delete(l.conns, c)
+		c.detach()
+	}
+	return snapshots, nil
+}
+
+// Restore resumes the connections of a snapshot as server conns and tracks
+// them as if they had been accepted by this listener.
+// Connections that can't be resumed are closed and reported in the returned
+// error, along with the conns that were restored.
+func (l *Listener) Restore(ctx context.Context, snapshots []ConnSnapshot) ([]*Conn, error) {
+	var conns []*Conn
+	var errs []error
+	for _, s := range snapshots {
+		c, err := ServerContext(ctx, s.Conn, l.cfg, s.State, l.opts...)
+		if err != nil {
+			_ = s.Conn.Close()
+			errs = append(errs, fmt.Errorf("resumetls: couldn't restore conn from %s: %w", s.Conn.RemoteAddr(), err))
+			continue
+		}
+		l.track(c, s.Conn)
+		conns = append(conns, c)
+	}
+	return conns, errors.Join(errs...)
+}
+
+// track tracks a conn until it is closed
+func (l *Listener) track(c *Conn, conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns[c] = conn
+	c.onClose = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.conns, c)
+	}
+}
@@ -0,0 +1,180 @@
+package resumetls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListener(t *testing.T) {
+	pair := newCertificate(t)
+	srvCfg := &tls.Config{Certificates: []tls.Certificate{pair}}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, srvCfg)
+	defer ln.Close()
+
+	// Accepted conns are served by echo handlers
+	var handlers sync.WaitGroup
+	serve := func(c net.Conn) {
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			defer c.Close()
+			_, _ = io.Copy(c, c)
+		}()
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serve(c)
+		}
+	}()
+
+	var clients []*tls.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		defer client.Close()
+		clients = append(clients, client)
+		transfer(t, client, client, "hello")
+	}
+
+	// Closed conns aren't tracked
+	if err := clients[2].Close(); err != nil {
+		t.Fatal(err)
+	}
+	clients = clients[:2]
+	deadline := time.Now().Add(5 * time.Second)
+	for ln.tracked() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected tracked conns %d", ln.tracked())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Snapshot conns and stop the handlers without closing the connections
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	snapshots, err := ln.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("unexpected snapshots %d", len(snapshots))
+	}
+	handlers.Wait()
+	if n := ln.tracked(); n != 0 {
+		t.Fatalf("snapshotted conns still tracked: %d", n)
+	}
+
+	// Restore them in a new listener
+	inner2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln2 := NewListener(inner2, srvCfg)
+	defer ln2.Close()
+	restored, err := ln2.Restore(ctx, snapshots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range restored {
+		serve(c)
+	}
+	for _, client := range clients {
+		transfer(t, client, client, "restored")
+	}
+	if n := ln2.tracked(); n != 2 {
+		t.Fatalf("unexpected tracked conns %d", n)
+	}
+
+	// Snapshots can be taken again
+	snapshots, err = ln2.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("unexpected snapshots %d", len(snapshots))
+	}
+	handlers.Wait()
+}
+
+func TestListenerSnapshotHandshake(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, &tls.Config{Certificates: []tls.Certificate{newCertificate(t)}})
+	defer ln.Close()
+
+	// The client never sends its hello, so the handshake started by the
+	// handler doesn't complete
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = c.Read(make([]byte, 1))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The conn is closed instead of waiting for its handshake
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	snapshots, err := ln.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 0 || ln.tracked() != 0 {
+		t.Fatalf("unexpected snapshots %d, tracked conns %d", len(snapshots), ln.tracked())
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected closed conn, got %v", err)
+	}
+}
+
+func TestListenerRestoreError(t *testing.T) {
+	pair := newCertificate(t)
+	c, conn := handshakedConn(t, true, &tls.Config{InsecureSkipVerify: true}, &tls.Config{Certificates: []tls.Certificate{pair}})
+
+	// A client state can't be restored by a listener
+	ln := NewListener(nil, &tls.Config{Certificates: []tls.Certificate{pair}})
+	restored, err := ln.Restore(context.Background(), []ConnSnapshot{{Conn: conn, State: c.State()}})
+	if !errors.Is(err, ErrRoleMismatch) {
+		t.Fatalf("expected role mismatch error, got %v", err)
+	}
+	if len(restored) != 0 || ln.tracked() != 0 {
+		t.Fatal("unexpected restored conn")
+	}
+}
+
+// tracked returns the number of tracked conns
+func (l *Listener) tracked() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.conns)
+}
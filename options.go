@@ -0,0 +1,30 @@
+package resumetls
+
+// Option configures a resumable conn
+type Option func(*options)
+
+// options contains the configuration set by Option values
+type options struct {
+	reverify   bool
+	checkpoint *checkpointConfig
+	wal        string
+}
+
+// newOptions applies the given options
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithReverify makes resumed connections verify the peer certificate chain
+// again against the current time and roots, calling VerifyPeerCertificate and
+// VerifyConnection callbacks.
+// By default the chains verified by the original handshake are restored.
+func WithReverify() Option {
+	return func(o *options) {
+		o.reverify = true
+	}
+}
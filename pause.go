@@ -0,0 +1,240 @@
+package resumetls
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// errPaused is returned when pausing a conn that is already paused
+var errPaused = errors.New("resumetls: conn already paused")
+
+// pauseGate blocks reads and writes while a conn is paused and tracks the
+// operations in flight
+type pauseGate struct {
+	mu           sync.Mutex
+	cond         *sync.Cond
+	paused       bool
+	closed       bool
+	detached     bool
+	reads        int
+	writes       int
+	interrupted  bool
+	readDeadline time.Time
+	// checkpointing is set while the conn is paused by a checkpoint
+	checkpointing bool
+	// skipped is set when a checkpoint is skipped because of a write in
+	// flight, until the writes exit
+	skipped bool
+}
+
+// wait waits for a change in the gate, mu must be held
+func (g *pauseGate) wait() {
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.mu)
+	}
+	g.cond.Wait()
+}
+
+// broadcast wakes up waiters, mu must be held
+func (g *pauseGate) broadcast() {
+	if g.cond != nil {
+		g.cond.Broadcast()
+	}
+}
+
+// enter waits until the conn isn't paused and increments the counter of
+// operations in flight
+func (g *pauseGate) enter(count *int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused && !g.closed {
+		g.wait()
+	}
+	if g.closed {
+		return net.ErrClosed
+	}
+	*count++
+	return nil
+}
+
+// exitWrite decrements the counter of writes in flight and returns whether a
+// checkpoint skipped because of the writes must be retried
+func (g *pauseGate) exitWrite() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writes--
+	g.broadcast()
+	retry := g.skipped && g.writes == 0
+	if retry {
+		g.skipped = false
+	}
+	return retry
+}
+
+// exitRead decrements the counter of reads in flight and returns whether the
+// read was interrupted by a pause and must be retried
+func (g *pauseGate) exitRead(n int, err error) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.reads--
+	g.broadcast()
+	retry := g.interrupted && !g.closed && n == 0 && errors.Is(err, os.ErrDeadlineExceeded)
+	if g.reads == 0 {
+		g.interrupted = false
+	}
+	return retry
+}
+
+// close unblocks operations waiting for the conn to be unpaused and returns
+// whether the conn was detached
+func (g *pauseGate) close() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	g.broadcast()
+	return g.detached
+}
+
+// Pause blocks new reads and writes, waits for the ones in flight and returns
+// the state of the conn, which is guaranteed to be resumable as long as the
+// conn isn't used afterwards.
+// Blocked reads are interrupted and retried once the conn is unpaused, writes
+// in flight are waited for until the context is done.
+// The conn stays paused until Unpause is called.
+func (c *Conn) Pause(ctx context.Context) (*State, error) {
+	return c.pause(ctx, false)
+}
+
+// pause pauses the conn for the application or for a checkpoint. Pauses
+// requested by the application wait for a checkpoint in progress, checkpoints
+// fail with errPaused if the conn is already paused and with errWriting if a
+// write is in flight, so they never block reads and writes while waiting for
+// a write.
+func (c *Conn) pause(ctx context.Context, checkpoint bool) (*State, error) {
+	if !c.isHandshaked() {
+		return nil, errHandshakeIncomplete
+	}
+	g := &c.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.broadcast()
+	})
+	defer stop()
+	for g.paused && g.checkpointing && !checkpoint && !g.closed {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		g.wait()
+	}
+	if g.closed {
+		return nil, net.ErrClosed
+	}
+	if g.paused {
+		return nil, errPaused
+	}
+	if checkpoint && g.writes > 0 {
+		g.skipped = true
+		return nil, errWriting
+	}
+	g.paused = true
+	g.checkpointing = checkpoint
+
+	// Interrupt reads blocked waiting for data
+	if g.reads > 0 {
+		g.interrupted = true
+		_ = c.Conn.SetReadDeadline(time.Unix(1, 0))
+	}
+	var err error
+	for (g.reads > 0 || g.writes > 0) && !g.closed && err == nil {
+		if err = ctx.Err(); err == nil {
+			g.wait()
+		}
+	}
+	_ = c.Conn.SetReadDeadline(g.readDeadline)
+	// A conn closed while waiting may be writing its close_notify alert
+	if g.closed {
+		err = net.ErrClosed
+	}
+	var state *State
+	if err == nil {
+		state, err = c.state()
+	}
+	if err != nil {
+		g.paused = false
+		g.checkpointing = false
+		g.broadcast()
+		return nil, err
+	}
+	return state, nil
+}
+
+// Unpause unblocks reads and writes of a paused conn
+func (c *Conn) Unpause() {
+	g := &c.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = false
+	g.checkpointing = false
+	g.broadcast()
+}
+
+// Buffered returns the number of received bytes that haven't been read yet,
+// including records that haven't been decrypted
+func (s *State) Buffered() int {
+	return len(s.pending.rawInput) + len(s.pending.input) + len(s.pending.hand)
+}
+
+// SetDeadline overrides tls deadlines to keep track of the read deadline
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline overrides tls read deadlines, the read deadline is
+// restored after pausing
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	g := &c.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// detach closes a paused conn without closing the tls conn, which belongs to
+// the conn resumed from its state. Blocked reads and writes return
+// net.ErrClosed and closing it doesn't send a close notify alert.
+func (c *Conn) detach() {
+	c.checkpoints.stop()
+	c.wal.close()
+	g := &c.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.detached = true
+	g.closed = true
+	g.broadcast()
+}
+
+// Close overrides tls close to unblock reads and writes of a paused conn
+func (c *Conn) Close() error {
+	c.checkpoints.stop()
+	detached := c.gate.close()
+	if c.onClose != nil {
+		c.onClose()
+	}
+	if detached {
+		return nil
+	}
+	// The close_notify alert is logged before the log is closed
+	err := c.Conn.Close()
+	c.wal.close()
+	return err
+}
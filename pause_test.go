@@ -0,0 +1,138 @@
+package resumetls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPause(t *testing.T) {
+	cli, cConn := handshakedConn(t, true, &tls.Config{InsecureSkipVerify: true},
+		&tls.Config{Certificates: []tls.Certificate{newCertificate(t)}})
+
+	// A read blocked waiting for data
+	type result struct {
+		data []byte
+		err  error
+	}
+	readC := make(chan result, 1)
+	go func() {
+		recv := make([]byte, 1024)
+		n, err := cli.Read(recv)
+		readC <- result{recv[:n], err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	state, err := cli.Pause(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Pause(ctx); !errors.Is(err, errPaused) {
+		t.Fatalf("expected already paused error, got %v", err)
+	}
+	if state.Buffered() != 0 {
+		t.Fatalf("unexpected buffered bytes %d", state.Buffered())
+	}
+
+	// Writes are blocked while paused
+	writeC := make(chan error, 1)
+	go func() {
+		_, err := cli.Write([]byte("Hello"))
+		writeC <- err
+	}()
+	select {
+	case err := <-writeC:
+		t.Fatalf("write completed while paused: %v", err)
+	case r := <-readC:
+		t.Fatalf("read completed while paused: %v", r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Blocked operations continue after unpausing
+	cli.Unpause()
+	if err := <-writeC; err != nil {
+		t.Fatal(err)
+	}
+	r := <-readC
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if string(r.data) != "Hello" {
+		t.Fatalf("unexpected message %q", r.data)
+	}
+
+	// The state of a paused conn is resumable
+	if state, err = cli.Pause(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cli2, err := Client(cConn, &tls.Config{
+		InsecureSkipVerify: true,
+	}, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, cli2)
+}
+
+func TestPauseTimeout(t *testing.T) {
+	cli, _ := handshakedConn(t, true, &tls.Config{InsecureSkipVerify: true},
+		&tls.Config{Certificates: []tls.Certificate{newCertificate(t)}})
+
+	// The echo isn't read so the write blocks
+	writeC := make(chan error, 1)
+	go func() {
+		_, err := cli.Write(make([]byte, 1<<20))
+		writeC <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := cli.Pause(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	// The conn isn't paused after a failed pause
+	cli.gate.mu.Lock()
+	paused := cli.gate.paused
+	cli.gate.mu.Unlock()
+	if paused {
+		t.Fatal("conn still paused")
+	}
+}
+
+func TestPauseBeforeHandshake(t *testing.T) {
+	_, cConn := net.Pipe()
+	defer cConn.Close()
+	cli, err := Client(cConn, &tls.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Pause(context.Background()); !errors.Is(err, errHandshakeIncomplete) {
+		t.Fatalf("expected handshake error, got %v", err)
+	}
+
+	// A handshake in progress, started by a read, doesn't block pauses
+	go func() {
+		_, _ = cli.Read(make([]byte, 1))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		_, err := cli.Pause(context.Background())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errHandshakeIncomplete) {
+			t.Fatalf("expected handshake error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pause blocked by the handshake in progress")
+	}
+}
@@ -0,0 +1,161 @@
+package reconnect
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/igolaizola/resumetls"
+)
+
+// Delays between dial attempts of a client continuing a session
+const (
+	minRedialDelay = 50 * time.Millisecond
+	maxRedialDelay = 2 * time.Second
+)
+
+// DialFunc dials a new transport to the server
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// Client establishes a new session with the server and returns a conn that
+// dials a new transport with dial and continues the session whenever the
+// current transport breaks.
+// The handshake is completed before returning.
+func Client(ctx context.Context, dial DialFunc, cfg *tls.Config, opts ...Option) (*Conn, error) {
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o := newOptions(opts)
+	var flags byte
+	if o.reliable {
+		flags |= flagReliable
+	}
+	raw := &transport{Conn: conn}
+	var id sessionID
+	err = preamble(ctx, raw, func() error {
+		if err := writeHello(raw, kindNew, flags, id); err != nil {
+			return err
+		}
+		payload, err := readStatus(raw, idLen)
+		if err != nil {
+			return err
+		}
+		copy(id[:], payload)
+		return nil
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("reconnect: couldn't start session: %w", err)
+	}
+	tc, err := resumetls.Client(raw, cfg, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := tc.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	key, err := exportKey(tc, id)
+	if err != nil {
+		_ = tc.Close()
+		return nil, err
+	}
+	c := newConn(id, key, cfg, tc, raw, o)
+	if o.reliable {
+		c.stream = newStream()
+	}
+	c.continueWith = func(ctx context.Context, state *resumetls.State, local progress) (*resumetls.Conn, *transport, progress, error) {
+		return c.redial(ctx, dial, state, local)
+	}
+	return c, nil
+}
+
+// redial dials new transports until one continues the session or the timeout
+// expires
+func (c *Conn) redial(ctx context.Context, dial DialFunc, state *resumetls.State, local progress) (*resumetls.Conn, *transport, progress, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	delay := minRedialDelay
+	for {
+		tc, raw, peer, err := c.resume(ctx, dial, state, local)
+		if err == nil {
+			return tc, raw, peer, nil
+		}
+		if permanent(err) {
+			return nil, nil, peer, err
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("%w: %w", ErrSessionExpired, err)
+			}
+			return nil, nil, peer, err
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRedialDelay)
+	}
+}
+
+// resume dials a new transport and continues the session over it
+func (c *Conn) resume(ctx context.Context, dial DialFunc, state *resumetls.State, local progress) (*resumetls.Conn, *transport, progress, error) {
+	var peer progress
+	var prepared *resumetls.State
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, nil, peer, err
+	}
+	raw := &transport{Conn: conn}
+	err = preamble(ctx, raw, func() error {
+		if err := writeHello(raw, kindResume, 0, c.id); err != nil {
+			return err
+		}
+		nonce, err := readStatus(raw, nonceLen)
+		if err != nil {
+			return err
+		}
+		msg := appendProgress(proof(c.key, roleClient, nonce, c.id, local), local)
+		if _, err := raw.Write(msg); err != nil {
+			return err
+		}
+		payload, err := readStatus(raw, progressLen+macLen)
+		if err != nil {
+			return err
+		}
+		received := parseProgress(payload)
+		if !hmac.Equal(payload[progressLen:], proof(c.key, roleServer, nonce, c.id, received)) {
+			return errBadServerProof
+		}
+		peer = received
+		prepared, err = c.prepare(state, local, peer)
+		return err
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, peer, err
+	}
+	tc, err := resumetls.ClientContext(ctx, raw, c.cfg, prepared)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, peer, err
+	}
+	return tc, raw, peer, nil
+}
+
+// preamble runs the plaintext exchange that precedes the TLS records of a
+// transport, which is interrupted if the context is done
+func preamble(ctx context.Context, conn net.Conn, exchange func() error) error {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	err := exchange()
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,228 @@
+package reconnect
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/igolaizola/resumetls"
+)
+
+// Every transport starts with a plaintext hello sent by the client, which is
+// either a new session request answered with the session ID, or a resume
+// request answered with a challenge. The client proves the knowledge of the
+// session key and presents its progress (record sequence numbers and stream
+// bytes received), which the server compares with the progress of the
+// stored state. The server proves the knowledge of the key along with its
+// own progress, so the client doesn't continue with a progress forged by a
+// man in the middle.
+//
+//	hello:     magic "RTLR" | version | kind | flags | session ID
+//	accepted:  status | session ID
+//	challenge: status | nonce
+//	proof:     HMAC-SHA256(key, "C" | nonce | session ID | progress) | progress
+//	result:    status | progress | HMAC-SHA256(key, "S" | nonce | session ID | progress)
+//	progress:  in | out | received
+const (
+	protocolMagic   = "RTLR"
+	protocolVersion = 1
+
+	kindNew    byte = 1
+	kindResume byte = 2
+
+	// flagReliable requests a reliable stream for a new session
+	flagReliable byte = 1 << 0
+
+	idLen       = 16
+	nonceLen    = 32
+	macLen      = sha256.Size
+	keyLen      = 32
+	progressLen = 24
+
+	// exporterLabel is the label of the keying material used as session key
+	exporterLabel = "EXPORTER-resumetls-reconnect"
+
+	// Roles of the peer proving the knowledge of the session key, so a proof
+	// can't be reflected to the other peer
+	roleClient byte = 'C'
+	roleServer byte = 'S'
+)
+
+// Status codes sent by the server
+const (
+	statusOK byte = iota
+	statusUnknownSession
+	statusBadProof
+	statusRecordsLost
+	statusUnavailable
+)
+
+var (
+	// ErrUnknownSession is returned when the server doesn't have the session
+	// being resumed, because it expired or was closed
+	ErrUnknownSession = errors.New("reconnect: unknown session")
+	// ErrBadProof is returned when the server rejects the proof of a resume
+	// request
+	ErrBadProof = errors.New("reconnect: session proof rejected")
+	// errBadServerProof is returned when the result of a resume request isn't
+	// proven by the server, the client tries again with a new transport
+	errBadServerProof = errors.New("reconnect: invalid server proof")
+	// ErrRecordsLost is returned when the records sent by one peer weren't
+	// received by the other before the transport broke
+	ErrRecordsLost = errors.New("reconnect: records lost with the broken transport")
+	// ErrSessionExpired is returned when a broken session isn't resumed
+	// before the timeout
+	ErrSessionExpired = errors.New("reconnect: session wasn't resumed in time")
+)
+
+// sessionID identifies a session across transports
+type sessionID [idLen]byte
+
+// progress is what a peer received and sent over the transports of a session
+type progress struct {
+	// in and out are the record sequence numbers
+	in, out uint64
+	// received is the number of stream bytes received, only used by
+	// reliable streams
+	received uint64
+}
+
+// appendProgress appends the encoded progress to b
+func appendProgress(b []byte, p progress) []byte {
+	b = binary.BigEndian.AppendUint64(b, p.in)
+	b = binary.BigEndian.AppendUint64(b, p.out)
+	return binary.BigEndian.AppendUint64(b, p.received)
+}
+
+// parseProgress parses an encoded progress
+func parseProgress(b []byte) progress {
+	return progress{
+		in:       binary.BigEndian.Uint64(b),
+		out:      binary.BigEndian.Uint64(b[8:]),
+		received: binary.BigEndian.Uint64(b[16:]),
+	}
+}
+
+// checkProgress checks whether a session can continue from the progress of
+// both peers. Records lost with the broken transport are only tolerated by
+// reliable streams, which retransmit their data.
+func checkProgress(local, peer progress, reliable bool) error {
+	if peer.in == local.out && peer.out == local.in {
+		return nil
+	}
+	if !reliable {
+		return ErrRecordsLost
+	}
+	// A peer can't receive records that weren't sent
+	if peer.in > local.out || peer.out < local.in {
+		return fmt.Errorf("%w: inconsistent record sequence numbers", ErrRecordsLost)
+	}
+	return nil
+}
+
+// statusError returns the error of a status code
+func statusError(status byte) error {
+	switch status {
+	case statusOK:
+		return nil
+	case statusUnknownSession:
+		return ErrUnknownSession
+	case statusBadProof:
+		return ErrBadProof
+	case statusRecordsLost:
+		return ErrRecordsLost
+	case statusUnavailable:
+		return errors.New("reconnect: server unavailable")
+	default:
+		return fmt.Errorf("reconnect: unknown status %d", status)
+	}
+}
+
+// permanent returns whether an error prevents resuming a session
+func permanent(err error) bool {
+	for _, target := range []error{
+		ErrUnknownSession, ErrBadProof, ErrRecordsLost,
+		resumetls.ErrStateMismatch, resumetls.ErrStateCorrupt,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHello writes the hello of a new or resumed session
+func writeHello(w io.Writer, kind, flags byte, id sessionID) error {
+	b := append([]byte(protocolMagic), protocolVersion, kind, flags)
+	_, err := w.Write(append(b, id[:]...))
+	return err
+}
+
+// readHello reads the hello of a client
+func readHello(r io.Reader) (byte, byte, sessionID, error) {
+	var id sessionID
+	b := make([]byte, len(protocolMagic)+3+idLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, 0, id, err
+	}
+	if string(b[:len(protocolMagic)]) != protocolMagic {
+		return 0, 0, id, errors.New("reconnect: invalid hello")
+	}
+	b = b[len(protocolMagic):]
+	if v := b[0]; v != protocolVersion {
+		return 0, 0, id, fmt.Errorf("reconnect: unsupported protocol version %d", v)
+	}
+	kind, flags := b[1], b[2]
+	if kind != kindNew && kind != kindResume {
+		return 0, 0, id, fmt.Errorf("reconnect: invalid hello kind %d", kind)
+	}
+	copy(id[:], b[3:])
+	return kind, flags, id, nil
+}
+
+// writeStatus writes a status code followed by its payload
+func writeStatus(w io.Writer, status byte, payload []byte) error {
+	_, err := w.Write(append([]byte{status}, payload...))
+	return err
+}
+
+// readStatus reads a status code and its payload of length n, which is only
+// sent along with statusOK
+func readStatus(r io.Reader, n int) ([]byte, error) {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return nil, err
+	}
+	if err := statusError(status[0]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// proof returns the proof of the progress presented by a peer in a resume
+// request
+func proof(key []byte, role byte, nonce []byte, id sessionID, p progress) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{role})
+	mac.Write(nonce)
+	mac.Write(id[:])
+	mac.Write(appendProgress(nil, p))
+	return mac.Sum(nil)
+}
+
+// exportKey derives the session key from a handshaked conn
+func exportKey(c *resumetls.Conn, id sessionID) ([]byte, error) {
+	cs := c.ConnectionState()
+	key, err := cs.ExportKeyingMaterial(exporterLabel, id[:], keyLen)
+	if err != nil {
+		return nil, fmt.Errorf("reconnect: couldn't derive session key: %w", err)
+	}
+	return key, nil
+}
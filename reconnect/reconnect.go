@@ -0,0 +1,423 @@
+// Package reconnect continues resumable TLS sessions over new transports.
+//
+// Sessions are tagged with an ID when they are established. When the
+// transport breaks, the client dials a new one and presents the session ID
+// and the record sequence numbers of its state, the server rebinds the state
+// it kept to the new transport and the TLS session continues where it was
+// without a new handshake. Reads and writes in flight are retried over the
+// new transport, so the breakage isn't noticed by the application.
+//
+// A session can only be continued if no records were lost with the broken
+// transport, otherwise both sides fail with ErrRecordsLost. Reliable streams,
+// enabled with WithReliableDelivery, keep the data sent until the peer
+// acknowledges it and retransmit the data lost instead, so the application
+// sees a lossless stream across transports.
+package reconnect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/igolaizola/resumetls"
+)
+
+// DefaultTimeout is how long a broken session can take to be resumed
+const DefaultTimeout = 30 * time.Second
+
+// errTransportClosed is returned instead of io.EOF by transports, so a
+// transport closed without a close_notify alert isn't mistaken for the end
+// of the session
+var errTransportClosed = errors.New("reconnect: transport closed")
+
+// Option configures a reconnecting conn or listener
+type Option func(*options)
+
+// options contains the configuration set by Option values
+type options struct {
+	timeout  time.Duration
+	reliable bool
+}
+
+// newOptions applies the given options
+func newOptions(opts []Option) *options {
+	o := &options{timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithTimeout sets how long a broken session can take to be resumed: how long
+// clients keep dialing and how long servers keep the session waiting for the
+// client to come back. Defaults to DefaultTimeout.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithReliableDelivery makes a client establish a reliable stream: data lost
+// with a broken transport is retransmitted instead of failing the session.
+// Both peers must read the data sent by the other, since data is only
+// acknowledged once it is read and at most 1 MiB is sent without being
+// acknowledged. Listeners accept reliable streams from clients that request
+// them, the option is ignored by listeners.
+func WithReliableDelivery() Option {
+	return func(o *options) {
+		o.reliable = true
+	}
+}
+
+// transport is a network conn that records whether it failed
+type transport struct {
+	net.Conn
+	failed atomic.Bool
+}
+
+// Read reports io.EOF as errTransportClosed, crypto/tls returns io.EOF for
+// both close_notify alerts and closed transports
+func (t *transport) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	if errors.Is(err, io.EOF) {
+		err = errTransportClosed
+	}
+	t.check(err)
+	return n, err
+}
+
+// Write records failed writes
+func (t *transport) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	t.check(err)
+	return n, err
+}
+
+// check marks the transport as failed on errors other than timeouts, which
+// are caused by deadlines
+func (t *transport) check(err error) {
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.failed.Store(true)
+	}
+}
+
+// Conn is a resumable TLS conn that continues over a new transport when the
+// current one breaks
+type Conn struct {
+	id      sessionID
+	key     []byte
+	cfg     *tls.Config
+	timeout time.Duration
+	// continueWith returns a conn that continues the state over a new
+	// transport and the progress of the peer
+	continueWith func(ctx context.Context, state *resumetls.State, local progress) (*resumetls.Conn, *transport, progress, error)
+	onClose      func()
+	// stream is the state of a reliable stream, nil otherwise
+	stream *stream
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	tc            *resumetls.Conn
+	raw           *transport
+	gen           uint64
+	recovering    bool
+	err           error
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// newConn returns a conn for an established session
+func newConn(id sessionID, key []byte, cfg *tls.Config, tc *resumetls.Conn, raw *transport, o *options) *Conn {
+	c := &Conn{
+		id:      id,
+		key:     key,
+		cfg:     cfg,
+		timeout: o.timeout,
+		tc:      tc,
+		raw:     raw,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// current returns the conn of the current transport, waiting for a recovery
+// in progress
+func (c *Conn) current() (*resumetls.Conn, *transport, uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.recovering && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return nil, nil, 0, net.ErrClosed
+	}
+	if c.err != nil {
+		return nil, nil, 0, c.err
+	}
+	return c.tc, c.raw, c.gen, nil
+}
+
+// broken returns whether an operation failed because of the transport of the
+// given generation
+func (c *Conn) broken(raw *transport, gen uint64) bool {
+	if raw.failed.Load() {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recovering || c.gen != gen
+}
+
+// Read reads data, continuing over a new transport if the current one breaks
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.stream != nil {
+		return c.readStream(b)
+	}
+	for {
+		tc, raw, gen, err := c.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := tc.Read(b)
+		if err == nil || n > 0 || !c.broken(raw, gen) {
+			return n, err
+		}
+		if err := c.recover(gen); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data, continuing over a new transport if the current one
+// breaks
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.stream != nil {
+		return c.writeStream(b)
+	}
+	var written int
+	for {
+		tc, raw, gen, err := c.current()
+		if err != nil {
+			return written, err
+		}
+		n, err := tc.Write(b[written:])
+		written += n
+		if err == nil || !c.broken(raw, gen) {
+			return written, err
+		}
+		if err := c.recover(gen); err != nil {
+			return written, err
+		}
+	}
+}
+
+// recover continues the session over a new transport if the given
+// generation is still the current one, otherwise it waits for the recovery
+// in progress
+func (c *Conn) recover(gen uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.recovering && !c.closed {
+		c.cond.Wait()
+	}
+	switch {
+	case c.closed:
+		return net.ErrClosed
+	case c.err != nil:
+		return c.err
+	case c.gen != gen:
+		return nil
+	}
+	c.recovering = true
+	tc, raw := c.tc, c.raw
+	c.mu.Unlock()
+
+	// Operations in flight over the broken transport are interrupted
+	_ = raw.SetDeadline(time.Unix(1, 0))
+	if c.stream != nil {
+		// Records already received are read, so their data isn't
+		// retransmitted
+		c.drain(tc, gen)
+	}
+	state, err := suspend(c.ctx, tc, raw, c.timeout)
+	var next *resumetls.Conn
+	var nextRaw *transport
+	var peer progress
+	if err == nil {
+		next, nextRaw, peer, err = c.continueWith(c.ctx, state, c.progress(state))
+	}
+
+	c.mu.Lock()
+	c.recovering = false
+	c.cond.Broadcast()
+	if c.closed {
+		if next != nil {
+			_ = next.Close()
+		}
+		return net.ErrClosed
+	}
+	if err != nil {
+		c.err = fmt.Errorf("reconnect: couldn't continue session: %w", err)
+		c.release()
+		return c.err
+	}
+	if !c.readDeadline.IsZero() {
+		_ = next.SetReadDeadline(c.readDeadline)
+	}
+	if !c.writeDeadline.IsZero() {
+		_ = next.SetWriteDeadline(c.writeDeadline)
+	}
+	c.tc, c.raw = next, nextRaw
+	c.gen++
+	if c.stream != nil {
+		// The data the peer didn't receive is sent again
+		c.stream.rebase(c.gen, peer.received)
+		go func() { _ = c.flush() }()
+	}
+	return nil
+}
+
+// progress returns the progress of the session up to the given state
+func (c *Conn) progress(state *resumetls.State) progress {
+	in, out := state.RecordSequence()
+	p := progress{in: in, out: out}
+	if c.stream != nil {
+		c.stream.mu.Lock()
+		p.received = c.stream.received
+		c.stream.mu.Unlock()
+	}
+	return p
+}
+
+// prepare checks the progress of the peer and returns a copy of the state
+// prepared to continue the session, so the state can be prepared again for
+// another transport
+func (c *Conn) prepare(state *resumetls.State, local, peer progress) (*resumetls.State, error) {
+	if err := checkProgress(local, peer, c.stream != nil); err != nil {
+		return nil, err
+	}
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	prepared := &resumetls.State{}
+	if err := prepared.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if c.stream == nil {
+		return prepared, nil
+	}
+	if err := c.stream.check(peer.received); err != nil {
+		return nil, err
+	}
+	// The records lost are skipped, their data is retransmitted
+	if err := prepared.SkipRecords(peer.out); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRecordsLost, err)
+	}
+	return prepared, nil
+}
+
+// suspend stops the conn of a broken transport and returns its state.
+// The transport is closed before the conn, so no close_notify alert is sent.
+func suspend(ctx context.Context, tc *resumetls.Conn, raw *transport, timeout time.Duration) (*resumetls.State, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	state, err := tc.Pause(ctx)
+	_ = raw.Close()
+	_ = tc.Close()
+	if err != nil {
+		return nil, err
+	}
+	state.TrimPartialRecord()
+	return state, nil
+}
+
+// release runs the close callback once the session can't be continued
+func (c *Conn) release() {
+	c.cancel()
+	if c.onClose != nil {
+		c.onClose()
+		c.onClose = nil
+	}
+}
+
+// Close closes the session, sending a close_notify alert to the peer over the
+// current transport
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.release()
+	c.cond.Broadcast()
+	tc := c.tc
+	c.mu.Unlock()
+	return tc.Close()
+}
+
+// ConnectionState returns basic TLS details about the session
+func (c *Conn) ConnectionState() tls.ConnectionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tc.ConnectionState()
+}
+
+// LocalAddr returns the local address of the current transport
+func (c *Conn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.raw.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the current transport
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.raw.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines, which are kept when the
+// session continues over a new transport
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, which is kept when the session
+// continues over a new transport
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.recovering {
+		return nil
+	}
+	return c.tc.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline, which is kept when the session
+// continues over a new transport
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	if c.recovering {
+		return nil
+	}
+	return c.tc.SetWriteDeadline(t)
+}
@@ -0,0 +1,498 @@
+package reconnect
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		t.Run(tls.VersionName(version), func(t *testing.T) {
+			ln, errs := echoServer(t)
+			p := newProxy(t, ln.Addr().String())
+			c := newClient(t, p, version)
+			defer c.Close()
+			echo(t, c, "hello")
+
+			// Break the transport while a read is blocked, the read continues
+			// over a new transport
+			for i := 1; i <= 3; i++ {
+				recv := make(chan string, 1)
+				go func() {
+					b := make([]byte, 5)
+					_, err := io.ReadFull(c, b)
+					if err != nil {
+						recv <- err.Error()
+						return
+					}
+					recv <- string(b)
+				}()
+				time.Sleep(50 * time.Millisecond)
+				p.kill()
+				waitGeneration(t, c, uint64(i))
+				if _, err := c.Write([]byte("again")); err != nil {
+					t.Fatal(err)
+				}
+				if got := <-recv; got != "again" {
+					t.Fatalf("unexpected echo %q", got)
+				}
+				echo(t, c, "after reconnect")
+			}
+
+			// Closing the session ends it on the server
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatalf("unexpected server error %v", err)
+			}
+		})
+	}
+}
+
+func TestReconnectRecordsLost(t *testing.T) {
+	ln, errs := echoServer(t)
+	p := newProxy(t, ln.Addr().String())
+	c := newClient(t, p, tls.VersionTLS13)
+	defer c.Close()
+	echo(t, c, "hello")
+
+	// A record lost with the broken transport can't be recovered
+	p.setDropping(true)
+	if _, err := c.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	p.setDropping(false)
+	p.kill()
+	if _, err := c.Read(make([]byte, 4)); !errors.Is(err, ErrRecordsLost) {
+		t.Fatalf("expected records lost error, got %v", err)
+	}
+	if err := <-errs; !errors.Is(err, ErrRecordsLost) {
+		t.Fatalf("expected records lost server error, got %v", err)
+	}
+}
+
+func TestReconnectReliable(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		t.Run(tls.VersionName(version), func(t *testing.T) {
+			ln, errs := echoServer(t)
+			p := newProxy(t, ln.Addr().String())
+			c := newClient(t, p, version, WithReliableDelivery())
+			defer c.Close()
+			echo(t, c, "hello")
+
+			// Data lost with the broken transport is retransmitted over the
+			// new one
+			for i := 1; i <= 3; i++ {
+				p.setDropping(true)
+				if _, err := c.Write([]byte("lost")); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(50 * time.Millisecond)
+				p.setDropping(false)
+				p.kill()
+				recv := make([]byte, 4)
+				if _, err := io.ReadFull(c, recv); err != nil {
+					t.Fatal(err)
+				}
+				if string(recv) != "lost" {
+					t.Fatalf("unexpected echo %q", recv)
+				}
+				waitGeneration(t, c, uint64(i))
+				echo(t, c, "after reconnect")
+			}
+
+			// Data larger than the window is delivered in order
+			data := make([]byte, 3*streamWindow)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			recv := make(chan []byte, 1)
+			go func() {
+				b := make([]byte, len(data))
+				_, _ = io.ReadFull(c, b)
+				recv <- b
+			}()
+			if _, err := c.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-recv; !bytes.Equal(got, data) {
+				t.Fatal("unexpected echo of large data")
+			}
+
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatalf("unexpected server error %v", err)
+			}
+		})
+	}
+}
+
+func TestReconnectExpired(t *testing.T) {
+	ln, errs := echoServer(t, WithTimeout(200*time.Millisecond))
+	p := newProxy(t, ln.Addr().String())
+	c := newClient(t, p, tls.VersionTLS13, WithTimeout(200*time.Millisecond))
+	defer c.Close()
+	echo(t, c, "hello")
+
+	// Sessions expire when no transport can be established
+	p.setRefusing(true)
+	p.kill()
+	if _, err := c.Read(make([]byte, 4)); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expected session expired error, got %v", err)
+	}
+	if err := <-errs; !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expected session expired server error, got %v", err)
+	}
+
+	// Expired sessions are forgotten by the server
+	p.setRefusing(false)
+	state := c.tc.State()
+	_, _, _, err := c.resume(context.Background(), p.dial, state, c.progress(state))
+	if !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("expected unknown session error, got %v", err)
+	}
+}
+
+func TestReconnectServerProof(t *testing.T) {
+	ln, _ := echoServer(t)
+	p := newProxy(t, ln.Addr().String())
+	c := newClient(t, p, tls.VersionTLS13, WithReliableDelivery())
+	defer c.Close()
+	echo(t, c, "hello")
+
+	// A man in the middle answers the resume request with a forged progress
+	state := c.tc.State()
+	local := c.progress(state)
+	dial := func(context.Context) (net.Conn, error) {
+		cConn, sConn := net.Pipe()
+		go func() {
+			defer sConn.Close()
+			if _, _, _, err := readHello(sConn); err != nil {
+				return
+			}
+			if err := writeStatus(sConn, statusOK, make([]byte, nonceLen)); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(sConn, make([]byte, macLen+progressLen)); err != nil {
+				return
+			}
+			forged := progress{in: local.out, out: local.in, received: 0}
+			result := appendProgress(nil, forged)
+			_ = writeStatus(sConn, statusOK, append(result, make([]byte, macLen)...))
+		}()
+		return cConn, nil
+	}
+	if _, _, _, err := c.resume(context.Background(), dial, state, local); !errors.Is(err, errBadServerProof) {
+		t.Fatalf("expected bad server proof error, got %v", err)
+	}
+	echo(t, c, "after forged result")
+}
+
+func TestReconnectPrepare(t *testing.T) {
+	ln, _ := echoServer(t)
+	p := newProxy(t, ln.Addr().String())
+	c := newClient(t, p, tls.VersionTLS13, WithReliableDelivery())
+	defer c.Close()
+	echo(t, c, "hello")
+	state := c.tc.State()
+	local := c.progress(state)
+	c.stream.mu.Lock()
+	received := c.stream.sent
+	c.stream.mu.Unlock()
+
+	// Records lost with a transport are skipped in a copy of the state, so
+	// the state can be prepared again for another transport
+	lost := progress{in: local.out, out: local.in + 2, received: received}
+	prepared, err := c.prepare(state, local, lost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.progress(prepared).in; got != local.in+2 {
+		t.Fatalf("unexpected prepared sequence number %d", got)
+	}
+	if got := c.progress(state).in; got != local.in {
+		t.Fatalf("prepared state not copied, sequence number %d", got)
+	}
+	if _, err := c.prepare(state, local, progress{in: local.out, out: local.in, received: received}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenerAcceptQueue(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, &tls.Config{Certificates: []tls.Certificate{newCertificate(t)}})
+	defer ln.Close()
+	p := newProxy(t, ln.Addr().String())
+
+	// Sessions that don't fit in the queue are closed
+	for i := 0; i <= acceptQueueLen; i++ {
+		c := newClient(t, p, tls.VersionTLS13)
+		defer c.Close()
+	}
+	sessions := func() int {
+		ln.mu.Lock()
+		defer ln.mu.Unlock()
+		return len(ln.sessions)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ln.accepted) != acceptQueueLen || sessions() != acceptQueueLen {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected queued sessions %d, sessions %d", len(ln.accepted), sessions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Queued sessions are closed with the listener
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sessions(); n != 0 {
+		t.Fatalf("unexpected sessions %d", n)
+	}
+}
+
+func TestStreamOffsets(t *testing.T) {
+	frame := func(offset uint64, payload string) []byte {
+		b := binary.BigEndian.AppendUint64([]byte{frameData}, offset)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+		return append(b, payload...)
+	}
+	s := newStream()
+	if err := s.parse(frame(0, "hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Data must continue from the data received
+	for _, offset := range []uint64{3, 6} {
+		s := newStream()
+		s.buffered, s.received = []byte("hello"), 5
+		if err := s.parse(frame(offset, "world"), 0); err == nil {
+			t.Fatalf("expected error for data at offset %d", offset)
+		}
+	}
+	if err := s.parse(frame(5, " world"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(s.buffered) != "hello world" {
+		t.Fatalf("unexpected data %q", s.buffered)
+	}
+}
+
+// echoServer starts a listener that echoes data back on every session and
+// reports the error of each session
+func echoServer(t *testing.T, opts ...Option) (*Listener, <-chan error) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{newCertificate(t)}}
+	ln := NewListener(inner, cfg, opts...)
+	t.Cleanup(func() { _ = ln.Close() })
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, err := io.Copy(c, c)
+				errs <- err
+			}()
+		}
+	}()
+	return ln, errs
+}
+
+// newClient establishes a session through the proxy
+func newClient(t *testing.T, p *proxy, version uint16, opts ...Option) *Conn {
+	t.Helper()
+	cfg := &tls.Config{InsecureSkipVerify: true, MinVersion: version, MaxVersion: version}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Client(ctx, p.dial, cfg, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// echo writes a message and checks it is echoed back
+func echo(t *testing.T, c net.Conn, message string) {
+	t.Helper()
+	if _, err := c.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	recv := make([]byte, len(message))
+	if _, err := io.ReadFull(c, recv); err != nil {
+		t.Fatal(err)
+	}
+	if string(recv) != message {
+		t.Fatalf("unexpected echo %q", recv)
+	}
+}
+
+// waitGeneration waits until the session continued over the given number of
+// new transports
+func waitGeneration(t *testing.T, c *Conn, gen uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		current := c.gen
+		c.mu.Unlock()
+		if current == gen {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session not continued, generation %d", current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// proxy forwards transports to a target and breaks them on demand
+type proxy struct {
+	ln     net.Listener
+	target string
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	dropping bool
+	refusing bool
+}
+
+// newProxy starts a proxy to target
+func newProxy(t *testing.T, target string) *proxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{ln: ln, target: target}
+	t.Cleanup(func() {
+		_ = ln.Close()
+		p.kill()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.forward(conn)
+		}
+	}()
+	return p
+}
+
+// dial dials the proxy
+func (p *proxy) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", p.ln.Addr().String())
+}
+
+// forward forwards data between conn and a new conn to the target
+func (p *proxy) forward(conn net.Conn) {
+	p.mu.Lock()
+	refusing := p.refusing
+	p.mu.Unlock()
+	if refusing {
+		_ = conn.Close()
+		return
+	}
+	target, err := net.Dial("tcp", p.target)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	p.mu.Lock()
+	p.conns = append(p.conns, conn, target)
+	p.mu.Unlock()
+	go func() {
+		_, _ = io.Copy(conn, target)
+		_ = conn.Close()
+	}()
+	b := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		p.mu.Lock()
+		dropping := p.dropping
+		p.mu.Unlock()
+		if dropping {
+			continue
+		}
+		if _, err := target.Write(b[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// kill closes every forwarded transport
+func (p *proxy) kill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		_ = c.Close()
+	}
+	p.conns = nil
+}
+
+// setDropping makes the proxy discard data sent by clients
+func (p *proxy) setDropping(dropping bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropping = dropping
+}
+
+// setRefusing makes the proxy close new transports
+func (p *proxy) setRefusing(refusing bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refusing = refusing
+}
+
+// newCertificate generates a self signed certificate
+func newCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
@@ -0,0 +1,287 @@
+package reconnect
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/resumetls"
+)
+
+// handshakeTimeout bounds the preamble and the handshake of new transports
+const handshakeTimeout = 10 * time.Second
+
+// acceptQueueLen is the number of established sessions waiting for Accept,
+// new sessions are closed while the queue is full
+const acceptQueueLen = 64
+
+// rebind is a new transport presented by a client to continue a session
+type rebind struct {
+	raw   *transport
+	nonce []byte
+	peer  progress
+}
+
+// Listener accepts sessions that continue over new transports when the
+// current one breaks.
+// Sessions can only be continued while the listener is open.
+type Listener struct {
+	inner    net.Listener
+	cfg      *tls.Config
+	opts     *options
+	accepted chan *Conn
+	done     chan struct{}
+	once     sync.Once
+
+	mu       sync.Mutex
+	sessions map[sessionID]*serverSession
+}
+
+// serverSession is a session waiting for new transports
+type serverSession struct {
+	conn    *Conn
+	rebinds chan rebind
+}
+
+// NewListener returns a listener that accepts sessions from clients connecting
+// to inner
+func NewListener(inner net.Listener, cfg *tls.Config, opts ...Option) *Listener {
+	l := &Listener{
+		inner:    inner,
+		cfg:      cfg,
+		opts:     newOptions(opts),
+		accepted: make(chan *Conn, acceptQueueLen),
+		done:     make(chan struct{}),
+		sessions: map[sessionID]*serverSession{},
+	}
+	go l.serve()
+	return l
+}
+
+// Accept waits for the next session and returns it once its handshake is
+// completed.
+// Established sessions wait in a bounded queue, new ones are closed while it
+// is full.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting sessions and transports.
+// Accepted sessions aren't closed, but they can't be continued anymore.
+// Sessions waiting to be accepted are closed.
+func (l *Listener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.done)
+		err = l.inner.Close()
+		l.drain()
+	})
+	return err
+}
+
+// drain closes the sessions waiting to be accepted
+func (l *Listener) drain() {
+	for {
+		select {
+		case c := <-l.accepted:
+			_ = c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Addr returns the address of the inner listener
+func (l *Listener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+// serve accepts transports until the listener is closed
+func (l *Listener) serve() {
+	for {
+		conn, err := l.inner.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			_ = l.Close()
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+// handle starts a new session or continues an existing one over a transport
+func (l *Listener) handle(conn net.Conn) {
+	raw := &transport{Conn: conn}
+	_ = raw.SetDeadline(time.Now().Add(handshakeTimeout))
+	kind, flags, id, err := readHello(raw)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	if kind == kindNew {
+		err = l.start(raw, flags&flagReliable != 0)
+	} else {
+		err = l.resume(raw, id)
+	}
+	if err != nil {
+		_ = conn.Close()
+	}
+}
+
+// start establishes a new session, with a reliable stream if requested
+func (l *Listener) start(raw *transport, reliable bool) error {
+	var id sessionID
+	if _, err := rand.Read(id[:]); err != nil {
+		_ = writeStatus(raw, statusUnavailable, nil)
+		return err
+	}
+	if err := writeStatus(raw, statusOK, id[:]); err != nil {
+		return err
+	}
+	tc, err := resumetls.Server(raw, l.cfg, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	key, err := exportKey(tc, id)
+	if err != nil {
+		return err
+	}
+	_ = raw.SetDeadline(time.Time{})
+
+	c := newConn(id, key, l.cfg, tc, raw, l.opts)
+	if reliable {
+		c.stream = newStream()
+	}
+	s := &serverSession{conn: c, rebinds: make(chan rebind)}
+	c.continueWith = func(ctx context.Context, state *resumetls.State, local progress) (*resumetls.Conn, *transport, progress, error) {
+		return l.await(ctx, s, state, local)
+	}
+	c.onClose = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.sessions, id)
+	}
+	l.mu.Lock()
+	l.sessions[id] = s
+	l.mu.Unlock()
+	select {
+	case l.accepted <- c:
+	default:
+		// Sessions aren't accepted fast enough
+		_ = c.Close()
+	}
+	select {
+	case <-l.done:
+		// The listener was closed while the session was queued
+		l.drain()
+	default:
+	}
+	return nil
+}
+
+// resume verifies a client continuing a session and hands the transport to
+// the session
+func (l *Listener) resume(raw *transport, id sessionID) error {
+	l.mu.Lock()
+	s, ok := l.sessions[id]
+	l.mu.Unlock()
+	if !ok {
+		_ = writeStatus(raw, statusUnknownSession, nil)
+		return ErrUnknownSession
+	}
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		_ = writeStatus(raw, statusUnavailable, nil)
+		return err
+	}
+	if err := writeStatus(raw, statusOK, nonce); err != nil {
+		return err
+	}
+	msg := make([]byte, macLen+progressLen)
+	if _, err := io.ReadFull(raw, msg); err != nil {
+		return err
+	}
+	peer := parseProgress(msg[macLen:])
+	if !hmac.Equal(msg[:macLen], proof(s.conn.key, roleClient, nonce, id, peer)) {
+		_ = writeStatus(raw, statusBadProof, nil)
+		return ErrBadProof
+	}
+
+	// The session may not have noticed the broken transport yet
+	s.conn.mu.Lock()
+	gen := s.conn.gen
+	s.conn.mu.Unlock()
+	go func() { _ = s.conn.recover(gen) }()
+
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+	select {
+	case s.rebinds <- rebind{raw: raw, nonce: nonce, peer: peer}:
+		return nil
+	case <-s.conn.ctx.Done():
+		_ = writeStatus(raw, statusUnknownSession, nil)
+		return ErrUnknownSession
+	case <-timer.C:
+		_ = writeStatus(raw, statusUnavailable, nil)
+		return ErrSessionExpired
+	}
+}
+
+// await waits for the client to continue the session over a new transport
+func (l *Listener) await(ctx context.Context, s *serverSession, state *resumetls.State, local progress) (*resumetls.Conn, *transport, progress, error) {
+	timer := time.NewTimer(s.conn.timeout)
+	defer timer.Stop()
+	for {
+		var rb rebind
+		select {
+		case rb = <-s.rebinds:
+		case <-timer.C:
+			return nil, nil, progress{}, ErrSessionExpired
+		case <-ctx.Done():
+			return nil, nil, progress{}, ctx.Err()
+		}
+		prepared, err := s.conn.prepare(state, local, rb.peer)
+		if err != nil {
+			_ = writeStatus(rb.raw, statusRecordsLost, nil)
+			_ = rb.raw.Close()
+			return nil, nil, rb.peer, err
+		}
+		result := appendProgress(nil, local)
+		result = append(result, proof(s.conn.key, roleServer, rb.nonce, s.conn.id, local)...)
+		if err := writeStatus(rb.raw, statusOK, result); err != nil {
+			// The client can try again with another transport
+			_ = rb.raw.Close()
+			continue
+		}
+		hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		tc, err := resumetls.ServerContext(hctx, rb.raw, l.cfg, prepared)
+		cancel()
+		if err != nil {
+			// As when the status can't be written, the client can try again
+			// with another transport
+			_ = rb.raw.Close()
+			continue
+		}
+		_ = rb.raw.SetDeadline(time.Time{})
+		return tc, rb.raw, rb.peer, nil
+	}
+}
@@ -0,0 +1,366 @@
+package reconnect
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/igolaizola/resumetls"
+)
+
+// Reliable streams frame the application data inside the TLS session, so the
+// data lost with a broken transport is retransmitted.
+//
+//	data: frameData | offset (8 bytes) | length (2 bytes) | payload
+//	ack:  frameAck | offset (8 bytes)
+//
+// Data frames carry the stream offset of their payload, which must follow
+// the data received, so a gap or an overlap fails the stream instead of
+// corrupting it. Data sent is kept until the peer acknowledges it. Acknowledgements are sent
+// as the application reads the data, so the window also limits the data a
+// peer buffers before it is read.
+const (
+	frameData byte = 0
+	frameAck  byte = 1
+
+	dataHeaderLen = 11
+	ackFrameLen   = 9
+
+	// maxFramePayload fits a data frame in a single TLS record
+	maxFramePayload = 16384 - dataHeaderLen
+
+	// streamWindow is the maximum data sent and not acknowledged
+	streamWindow = 1 << 20
+	// ackThreshold is the data read before sending an acknowledgement
+	ackThreshold = streamWindow / 4
+)
+
+// errBroken is returned when a stream operation fails because of a broken
+// transport
+var errBroken = errors.New("reconnect: transport broken")
+
+// stream is the state of a reliable stream
+type stream struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// gen is the generation of the transport the stream is bound to
+	gen uint64
+
+	// flushMu serializes the data frames written
+	flushMu sync.Mutex
+	// unacked holds the data sent from offset acked to offset sent, data up
+	// to offset flushed was written to the current transport
+	unacked []byte
+	acked   uint64
+	flushed uint64
+	sent    uint64
+
+	// buffered holds the data received and not read yet, received is the
+	// offset of the data received, consumed the offset read and ackedIn the
+	// offset acknowledged to the peer
+	buffered  []byte
+	received  uint64
+	consumed  uint64
+	ackedIn   uint64
+	receiving bool
+	// rbuf is used to read from the transport while receiving
+	rbuf []byte
+	// header holds a partial frame header and frameLeft the payload bytes
+	// left in the current data frame
+	header    []byte
+	frameLeft int
+}
+
+// newStream returns a stream bound to the first transport
+func newStream() *stream {
+	s := &stream{rbuf: make([]byte, 16*1024)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// check checks whether the stream can continue from the data received by
+// the peer
+func (s *stream) check(peerReceived uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if peerReceived < s.acked || peerReceived > s.sent {
+		return fmt.Errorf("%w: stream offset %d outside of the retransmit buffer", ErrRecordsLost, peerReceived)
+	}
+	return nil
+}
+
+// rebase binds the stream to a new transport, dropping the data received by
+// the peer and discarding partial frames of the previous transport
+func (s *stream) rebase(gen, peerReceived uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unacked = s.unacked[peerReceived-s.acked:]
+	s.acked = peerReceived
+	s.flushed = peerReceived
+	s.header = s.header[:0]
+	s.frameLeft = 0
+	s.gen = gen
+	s.cond.Broadcast()
+}
+
+// parse processes the frames received over the transport of the given
+// generation
+func (s *stream) parse(b []byte, gen uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen != s.gen {
+		return nil
+	}
+	defer s.cond.Broadcast()
+	for len(b) > 0 {
+		if s.frameLeft > 0 {
+			n := min(s.frameLeft, len(b))
+			s.buffered = append(s.buffered, b[:n]...)
+			s.received += uint64(n)
+			s.frameLeft -= n
+			b = b[n:]
+			continue
+		}
+		if len(s.header) == 0 {
+			s.header = append(s.header, b[0])
+			b = b[1:]
+		}
+		var frameLen int
+		switch s.header[0] {
+		case frameData:
+			frameLen = dataHeaderLen
+		case frameAck:
+			frameLen = ackFrameLen
+		default:
+			return fmt.Errorf("reconnect: invalid stream frame type %d", s.header[0])
+		}
+		n := min(frameLen-len(s.header), len(b))
+		s.header = append(s.header, b[:n]...)
+		b = b[n:]
+		if len(s.header) < frameLen {
+			continue
+		}
+		if s.header[0] == frameData {
+			if offset := binary.BigEndian.Uint64(s.header[1:]); offset != s.received {
+				return fmt.Errorf("reconnect: stream data at offset %d, expected %d", offset, s.received)
+			}
+			s.frameLeft = int(binary.BigEndian.Uint16(s.header[9:]))
+		} else {
+			s.ack(binary.BigEndian.Uint64(s.header[1:]))
+		}
+		s.header = s.header[:0]
+	}
+	return nil
+}
+
+// ack drops the data acknowledged by the peer
+func (s *stream) ack(offset uint64) {
+	if offset <= s.acked || offset > s.sent {
+		return
+	}
+	s.unacked = s.unacked[offset-s.acked:]
+	s.acked = offset
+	if s.flushed < offset {
+		s.flushed = offset
+	}
+}
+
+// read copies buffered data into b, returning an acknowledgement frame to
+// send if enough data was read
+func (s *stream) read(b []byte) (int, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := copy(b, s.buffered)
+	s.buffered = s.buffered[n:]
+	s.consumed += uint64(n)
+	if s.consumed-s.ackedIn < ackThreshold {
+		return n, nil
+	}
+	s.ackedIn = s.consumed
+	return n, binary.BigEndian.AppendUint64([]byte{frameAck}, s.consumed)
+}
+
+// startReceiving reserves reading from the transport, otherwise it waits
+// for the stream to change and returns false
+func (s *stream) startReceiving(ready func() bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ready() {
+		return false
+	}
+	if s.receiving {
+		s.cond.Wait()
+		return false
+	}
+	s.receiving = true
+	return true
+}
+
+// stopReceiving releases reading from the transport
+func (s *stream) stopReceiving() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receiving = false
+	s.cond.Broadcast()
+}
+
+// readStream reads data from a reliable stream
+func (c *Conn) readStream(b []byte) (int, error) {
+	s := c.stream
+	ready := func() bool { return len(s.buffered) > 0 }
+	for {
+		n, ack := s.read(b)
+		if n > 0 || len(b) == 0 {
+			if ack != nil {
+				// Lost acknowledgements are exchanged again when the
+				// session continues
+				_ = c.writeFrame(ack)
+			}
+			return n, nil
+		}
+		if err := c.receive(ready); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// writeStream writes data to a reliable stream, data is retransmitted if
+// the transport breaks before the peer acknowledges it
+func (c *Conn) writeStream(b []byte) (int, error) {
+	s := c.stream
+	var written int
+	for written < len(b) {
+		chunk := b[written:min(len(b), written+maxFramePayload)]
+		if err := c.waitWindow(len(chunk)); err != nil {
+			return written, err
+		}
+		s.mu.Lock()
+		s.unacked = append(s.unacked, chunk...)
+		s.sent += uint64(len(chunk))
+		s.mu.Unlock()
+		written += len(chunk)
+		if err := c.flush(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// waitWindow waits for the peer to acknowledge enough data to send n bytes,
+// reading from the transport to receive the acknowledgements if no one else
+// is reading
+func (c *Conn) waitWindow(n int) error {
+	s := c.stream
+	ready := func() bool { return len(s.unacked)+n <= streamWindow }
+	for {
+		s.mu.Lock()
+		ok := ready()
+		s.mu.Unlock()
+		if ok {
+			return nil
+		}
+		if err := c.receive(ready); err != nil {
+			return err
+		}
+	}
+}
+
+// receive reads frames from the current transport once, unless the stream is
+// ready or someone else is reading, and continues over a new transport if the
+// current one breaks.
+// The transport is obtained before reserving the reception, since a
+// recovery drains the broken transport with the reception reserved.
+func (c *Conn) receive(ready func() bool) error {
+	tc, raw, gen, err := c.current()
+	if err != nil {
+		return err
+	}
+	s := c.stream
+	if !s.startReceiving(ready) {
+		return nil
+	}
+	n, err := tc.Read(s.rbuf)
+	if n > 0 {
+		err = s.parse(s.rbuf[:n], gen)
+	} else if err != nil && c.broken(raw, gen) {
+		err = errBroken
+	}
+	s.stopReceiving()
+	if errors.Is(err, errBroken) {
+		return c.recover(gen)
+	}
+	return err
+}
+
+// drain reads the data received before the transport broke, so it isn't
+// retransmitted by the peer
+func (c *Conn) drain(tc *resumetls.Conn, gen uint64) {
+	s := c.stream
+	s.mu.Lock()
+	for s.receiving {
+		s.cond.Wait()
+	}
+	s.receiving = true
+	s.mu.Unlock()
+	defer s.stopReceiving()
+	for {
+		n, err := tc.Read(s.rbuf)
+		if n > 0 {
+			_ = s.parse(s.rbuf[:n], gen)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// flush writes the data that wasn't written to the current transport
+func (c *Conn) flush() error {
+	s := c.stream
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	for {
+		tc, raw, gen, err := c.current()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.flushed == s.sent {
+			s.mu.Unlock()
+			return nil
+		}
+		start := s.flushed - s.acked
+		payload := s.unacked[start:min(uint64(len(s.unacked)), start+maxFramePayload)]
+		frame := binary.BigEndian.AppendUint64([]byte{frameData}, s.flushed)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+		frame = append(frame, payload...)
+		s.mu.Unlock()
+
+		_, err = tc.Write(frame)
+		if err == nil {
+			s.mu.Lock()
+			if s.gen == gen {
+				s.flushed += uint64(len(payload))
+			}
+			s.mu.Unlock()
+			continue
+		}
+		if !c.broken(raw, gen) {
+			return err
+		}
+		if err := c.recover(gen); err != nil {
+			return err
+		}
+	}
+}
+
+// writeFrame writes a control frame to the current transport
+func (c *Conn) writeFrame(frame []byte) error {
+	tc, _, _, err := c.current()
+	if err != nil {
+		return err
+	}
+	_, err = tc.Write(frame)
+	return err
+}
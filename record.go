@@ -0,0 +1,42 @@
+package resumetls
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/igolaizola/resumetls/record"
+)
+
+// errNotCompact is returned when record parameters are requested from a
+// state that doesn't contain key material
+var errNotCompact = errors.New("resumetls: record params require a compact state")
+
+// RecordParams returns the key material and record layer state of a compact
+// state, which can be used to continue the connection with the record
+// package instead of crypto/tls, without reflection nor unsafe.
+func (s *State) RecordParams() (*record.Params, error) {
+	if !s.compact() {
+		return nil, errNotCompact
+	}
+	return &record.Params{
+		Version:     s.version,
+		CipherSuite: s.cipherSuite,
+		In: record.Keys{
+			Key: cloneBytes(s.inKeys.Key),
+			IV:  cloneBytes(s.inKeys.IV),
+			MAC: cloneBytes(s.inKeys.MAC),
+		},
+		Out: record.Keys{
+			Key: cloneBytes(s.outKeys.Key),
+			IV:  cloneBytes(s.outKeys.IV),
+			MAC: cloneBytes(s.outKeys.MAC),
+		},
+		InSeq:     binary.BigEndian.Uint64(s.inSeq[:]),
+		OutSeq:    binary.BigEndian.Uint64(s.outSeq[:]),
+		InSecret:  cloneBytes(s.inSecret),
+		OutSecret: cloneBytes(s.outSecret),
+		RawInput:  cloneBytes(s.pending.rawInput),
+		Input:     cloneBytes(s.pending.input),
+		Hand:      cloneBytes(s.pending.hand),
+	}, nil
+}
@@ -0,0 +1,314 @@
+package record
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+
+	"github.com/igolaizola/resumetls/internal/suite"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	recordHeaderLen = 5
+	maxPlaintext    = 16384
+	// maxCiphertext is the maximum TLS 1.2 ciphertext length, TLS 1.3
+	// records are smaller
+	maxCiphertext = maxPlaintext + 2048
+)
+
+// errBadRecordMAC is returned when a record can't be authenticated
+var errBadRecordMAC = errors.New("record: bad record mac")
+
+// halfConn protects the records of one direction
+type halfConn struct {
+	version uint16
+	suite   *suite.Suite
+	keys    Keys
+	secret  []byte
+	seq     uint64
+
+	aead  cipher.AEAD
+	block cipher.Block
+	mac   hash.Hash
+}
+
+// newHalfConn returns a half conn using the given keys and sequence number
+func newHalfConn(version uint16, s *suite.Suite, keys Keys, secret []byte, seq uint64) (*halfConn, error) {
+	if version == tls.VersionTLS13 && len(secret) > 0 && len(secret) != s.Hash.Size() {
+		return nil, fmt.Errorf("record: invalid traffic secret length %d", len(secret))
+	}
+	h := &halfConn{version: version, suite: s, secret: secret, seq: seq}
+	if err := h.setKeys(keys); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// setKeys creates the record cipher for the given keys
+func (h *halfConn) setKeys(keys Keys) error {
+	s := h.suite
+	if len(keys.Key) != s.KeyLen || len(keys.IV) != s.IVLen || len(keys.MAC) != s.MACLen() {
+		return errors.New("record: invalid key material length")
+	}
+	h.aead, h.block, h.mac = nil, nil, nil
+	var err error
+	switch s.Kind {
+	case suite.AESGCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(keys.Key); err != nil {
+			return err
+		}
+		h.aead, err = cipher.NewGCM(block)
+	case suite.ChaCha20Poly1305:
+		h.aead, err = chacha20poly1305.New(keys.Key)
+	case suite.AESCBC:
+		h.block, err = aes.NewCipher(keys.Key)
+		h.mac = hmac.New(s.MAC.New, keys.MAC)
+	case suite.TripleDESCBC:
+		h.block, err = des.NewTripleDESCipher(keys.Key)
+		h.mac = hmac.New(s.MAC.New, keys.MAC)
+	default:
+		err = fmt.Errorf("record: unsupported cipher suite %s", tls.CipherSuiteName(s.ID))
+	}
+	if err != nil {
+		return err
+	}
+	h.keys = keys
+	return nil
+}
+
+// setTrafficSecret sets a TLS 1.3 traffic secret along with the keys derived
+// from it and resets the sequence number
+func (h *halfConn) setTrafficSecret(secret []byte) error {
+	keys := h.suite.KeysFromTrafficSecret(secret)
+	if err := h.setKeys(Keys{Key: keys.Key, IV: keys.IV}); err != nil {
+		return err
+	}
+	h.secret = secret
+	h.seq = 0
+	return nil
+}
+
+// updateTrafficSecret derives the next TLS 1.3 traffic secret
+func (h *halfConn) updateTrafficSecret() error {
+	if len(h.secret) == 0 {
+		return errors.New("record: key update requires the traffic secret")
+	}
+	return h.setTrafficSecret(suite.NextTrafficSecret(h.suite.Hash, h.secret))
+}
+
+// incSeq increments the sequence number, which must never wrap
+func (h *halfConn) incSeq() error {
+	if h.seq == math.MaxUint64 {
+		return errors.New("record: sequence number wraparound")
+	}
+	h.seq++
+	return nil
+}
+
+// xorNonce returns the IV xored with the sequence number, as used by TLS 1.3
+// and TLS 1.2 ChaCha20-Poly1305
+func (h *halfConn) xorNonce() []byte {
+	nonce := append([]byte{}, h.keys.IV...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], h.seq)
+	subtle.XORBytes(nonce[len(nonce)-8:], nonce[len(nonce)-8:], seq[:])
+	return nonce
+}
+
+// additionalData returns the TLS 1.2 additional data of a record
+func (h *halfConn) additionalData(typ byte, n int) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, h.seq)
+	return append(ad, typ, 3, 3, byte(n>>8), byte(n))
+}
+
+// encrypt returns a protected record containing data
+func (h *halfConn) encrypt(typ byte, data []byte) ([]byte, error) {
+	var record []byte
+	switch {
+	case h.version == tls.VersionTLS13:
+		inner := append(append([]byte{}, data...), typ)
+		n := len(inner) + h.aead.Overhead()
+		record = []byte{recordTypeApplicationData, 3, 3, byte(n >> 8), byte(n)}
+		record = h.aead.Seal(record, h.xorNonce(), inner, record)
+	case h.aead != nil && h.suite.Kind == suite.AESGCM:
+		// The explicit nonce is the sequence number
+		explicit := binary.BigEndian.AppendUint64(nil, h.seq)
+		nonce := append(append([]byte{}, h.keys.IV...), explicit...)
+		n := len(explicit) + len(data) + h.aead.Overhead()
+		record = []byte{typ, 3, 3, byte(n >> 8), byte(n)}
+		record = append(record, explicit...)
+		record = h.aead.Seal(record, nonce, data, h.additionalData(typ, len(data)))
+	case h.aead != nil:
+		n := len(data) + h.aead.Overhead()
+		record = []byte{typ, 3, 3, byte(n >> 8), byte(n)}
+		record = h.aead.Seal(record, h.xorNonce(), data, h.additionalData(typ, len(data)))
+	default:
+		// MAC then encrypt with a random explicit IV
+		bs := h.block.BlockSize()
+		h.mac.Reset()
+		h.mac.Write(h.additionalData(typ, len(data)))
+		h.mac.Write(data)
+		payload := h.mac.Sum(append([]byte{}, data...))
+		padding := bs - len(payload)%bs
+		for i := 0; i < padding; i++ {
+			payload = append(payload, byte(padding-1))
+		}
+		iv := make([]byte, bs)
+		if _, err := rand.Read(iv); err != nil {
+			return nil, err
+		}
+		cipher.NewCBCEncrypter(h.block, iv).CryptBlocks(payload, payload)
+		n := len(iv) + len(payload)
+		record = []byte{typ, 3, 3, byte(n >> 8), byte(n)}
+		record = append(append(record, iv...), payload...)
+	}
+	if err := h.incSeq(); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// decrypt authenticates and decrypts a record in place and returns its
+// content type and plaintext
+func (h *halfConn) decrypt(record []byte) (byte, []byte, error) {
+	typ := record[0]
+	payload := record[recordHeaderLen:]
+	var plaintext []byte
+	var err error
+	switch {
+	case h.version == tls.VersionTLS13:
+		if typ != recordTypeApplicationData {
+			return 0, nil, fmt.Errorf("record: unexpected record type %d", typ)
+		}
+		plaintext, err = h.aead.Open(payload[:0], h.xorNonce(), payload, record[:recordHeaderLen])
+		if err != nil {
+			return 0, nil, errBadRecordMAC
+		}
+		// The content type is the last non zero byte of the inner plaintext
+		typ = 0
+		for i := len(plaintext) - 1; i >= 0; i-- {
+			if plaintext[i] != 0 {
+				typ = plaintext[i]
+				plaintext = plaintext[:i]
+				break
+			}
+		}
+		if typ == 0 {
+			return 0, nil, errors.New("record: missing content type")
+		}
+	case h.aead != nil && h.suite.Kind == suite.AESGCM:
+		if len(payload) < 8+h.aead.Overhead() {
+			return 0, nil, errBadRecordMAC
+		}
+		nonce := append(append([]byte{}, h.keys.IV...), payload[:8]...)
+		ciphertext := payload[8:]
+		n := len(ciphertext) - h.aead.Overhead()
+		plaintext, err = h.aead.Open(ciphertext[:0], nonce, ciphertext, h.additionalData(typ, n))
+		if err != nil {
+			return 0, nil, errBadRecordMAC
+		}
+	case h.aead != nil:
+		if len(payload) < h.aead.Overhead() {
+			return 0, nil, errBadRecordMAC
+		}
+		n := len(payload) - h.aead.Overhead()
+		plaintext, err = h.aead.Open(payload[:0], h.xorNonce(), payload, h.additionalData(typ, n))
+		if err != nil {
+			return 0, nil, errBadRecordMAC
+		}
+	default:
+		if plaintext, err = h.decryptCBC(typ, payload); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := h.incSeq(); err != nil {
+		return 0, nil, err
+	}
+	return typ, plaintext, nil
+}
+
+// decryptCBC decrypts and authenticates a CBC record, padding and MAC are
+// checked in constant time as crypto/tls does
+func (h *halfConn) decryptCBC(typ byte, payload []byte) ([]byte, error) {
+	bs := h.block.BlockSize()
+	macSize := h.mac.Size()
+	minLen := bs + ((macSize+1+bs-1)/bs)*bs
+	if len(payload)%bs != 0 || len(payload) < minLen {
+		return nil, errBadRecordMAC
+	}
+	iv, payload := payload[:bs], payload[bs:]
+	cipher.NewCBCDecrypter(h.block, iv).CryptBlocks(payload, payload)
+
+	paddingLen, paddingGood := extractPadding(payload)
+	n := len(payload) - macSize - paddingLen
+	n = subtle.ConstantTimeSelect(int(uint32(n)>>31), 0, n)
+	remoteMAC := payload[n : n+macSize]
+
+	h.mac.Reset()
+	h.mac.Write(h.additionalData(typ, n))
+	h.mac.Write(payload[:n])
+	localMAC := h.mac.Sum(nil)
+	// The padding is hashed too so the time doesn't depend on its length
+	h.mac.Write(payload[n+macSize:])
+
+	if subtle.ConstantTimeCompare(localMAC, remoteMAC)&int(paddingGood) != 1 {
+		return nil, errBadRecordMAC
+	}
+	return payload[:n], nil
+}
+
+// extractPadding returns, in constant time, the length of the padding to
+// remove from the end of payload. It also returns a byte which is equal to
+// 255 if the padding was valid and 0 otherwise. See RFC 2246, Section 6.2.3.2.
+func extractPadding(payload []byte) (toRemove int, good byte) {
+	if len(payload) < 1 {
+		return 0, 0
+	}
+
+	paddingLen := payload[len(payload)-1]
+	t := uint(len(payload)-1) - uint(paddingLen)
+	// If len(payload) >= paddingLen+1 then the MSB of t is zero
+	good = byte(int32(^t) >> 31)
+
+	// The maximum possible padding length plus the actual length field
+	toCheck := 256
+	// The length of the padded data is public, so we can use an if here
+	if toCheck > len(payload) {
+		toCheck = len(payload)
+	}
+
+	for i := 0; i < toCheck; i++ {
+		t := uint(paddingLen) - uint(i)
+		// If i <= paddingLen then the MSB of t is zero
+		mask := byte(int32(^t) >> 31)
+		b := payload[len(payload)-1-i]
+		good &^= mask&paddingLen ^ mask&b
+	}
+
+	// AND together the bits of good and replicate the result across all
+	// the bits
+	good &= good << 4
+	good &= good << 2
+	good &= good << 1
+	good = uint8(int8(good) >> 7)
+
+	// Zero the padding length on error. This ensures any unchecked bytes
+	// are included in the MAC, otherwise an attacker that could distinguish
+	// MAC failures from padding failures could mount an attack similar to
+	// POODLE in SSL 3.0.
+	paddingLen &= good
+
+	toRemove = int(paddingLen) + 1
+	return toRemove, good
+}
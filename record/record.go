@@ -0,0 +1,432 @@
+// Package record implements the TLS 1.2 and TLS 1.3 record layer of an
+// established connection without using crypto/tls internals.
+//
+// A Conn is driven by exported keying material, such as the parameters
+// returned by resumetls.State.RecordParams, so connections can be resumed
+// without reflection nor unsafe.
+package record
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/resumetls/internal/suite"
+)
+
+const (
+	recordTypeChangeCipherSpec = 20
+	recordTypeAlert            = 21
+	recordTypeHandshake        = 22
+	recordTypeApplicationData  = 23
+
+	typeHelloRequest     = 0
+	typeNewSessionTicket = 4
+	typeKeyUpdate        = 24
+
+	alertLevelWarning = 1
+	alertCloseNotify  = 0
+	alertBadRecordMAC = 20
+)
+
+// Keys is the key material used to protect records in one direction
+type Keys struct {
+	Key []byte
+	IV  []byte
+	// MAC is the HMAC key of CBC cipher suites
+	MAC []byte
+}
+
+// Params contains the negotiated parameters and record layer state of an
+// established TLS connection
+type Params struct {
+	Version     uint16
+	CipherSuite uint16
+	In          Keys
+	Out         Keys
+	InSeq       uint64
+	OutSeq      uint64
+	// InSecret and OutSecret are the TLS 1.3 traffic secrets, required to
+	// process key updates
+	InSecret  []byte
+	OutSecret []byte
+	// RawInput contains received bytes that weren't decrypted yet
+	RawInput []byte
+	// Input contains decrypted application data that wasn't read yet
+	Input []byte
+	// Hand contains decrypted handshake data that wasn't processed yet
+	Hand []byte
+}
+
+// Conn is a TLS connection that only implements the record layer, so it can
+// only be used after the handshake has been completed
+type Conn struct {
+	conn    net.Conn
+	version uint16
+
+	inMu     sync.Mutex
+	in       *halfConn
+	rawInput bytes.Buffer
+	input    bytes.Reader
+	hand     bytes.Buffer
+	readErr  error
+
+	outMu           sync.Mutex
+	out             *halfConn
+	writeErr        error
+	closeNotifySent bool
+}
+
+// New returns a conn that continues a TLS connection over conn using the
+// given parameters
+func New(conn net.Conn, p *Params) (*Conn, error) {
+	s, err := suite.Lookup(p.Version, p.CipherSuite)
+	if err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	if p.Version != tls.VersionTLS13 && (len(p.InSecret) > 0 || len(p.OutSecret) > 0) {
+		return nil, errors.New("record: traffic secrets are only used in TLS 1.3")
+	}
+	in, err := newHalfConn(p.Version, s, cloneKeys(p.In), clone(p.InSecret), p.InSeq)
+	if err != nil {
+		return nil, err
+	}
+	out, err := newHalfConn(p.Version, s, cloneKeys(p.Out), clone(p.OutSecret), p.OutSeq)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:    conn,
+		version: p.Version,
+		in:      in,
+		out:     out,
+	}
+	c.rawInput.Write(p.RawInput)
+	c.input.Reset(clone(p.Input))
+	c.hand.Write(p.Hand)
+	return c, nil
+}
+
+// Params returns the current parameters of the conn, which can be used to
+// continue the connection with a new conn. Reads and writes are blocked while
+// the parameters are obtained.
+func (c *Conn) Params() *Params {
+	c.inMu.Lock()
+	defer c.inMu.Unlock()
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	input := make([]byte, c.input.Len())
+	_, _ = c.input.ReadAt(input, c.input.Size()-int64(c.input.Len()))
+	return &Params{
+		Version:     c.version,
+		CipherSuite: c.in.suite.ID,
+		In:          cloneKeys(c.in.keys),
+		Out:         cloneKeys(c.out.keys),
+		InSeq:       c.in.seq,
+		OutSeq:      c.out.seq,
+		InSecret:    clone(c.in.secret),
+		OutSecret:   clone(c.out.secret),
+		RawInput:    clone(c.rawInput.Bytes()),
+		Input:       input,
+		Hand:        clone(c.hand.Bytes()),
+	}
+}
+
+// Read reads application data, processing post-handshake messages and
+// alerts as they are received
+func (c *Conn) Read(b []byte) (int, error) {
+	c.inMu.Lock()
+	defer c.inMu.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for c.input.Len() == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.handlePostHandshake(); err != nil {
+			return 0, c.setReadErr(err)
+		}
+		if c.input.Len() > 0 {
+			break
+		}
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	return c.input.Read(b)
+}
+
+// setReadErr records a permanent read error
+func (c *Conn) setReadErr(err error) error {
+	c.readErr = err
+	return err
+}
+
+// readRecord reads and decrypts the next record, inMu must be held
+func (c *Conn) readRecord() error {
+	if err := c.fill(recordHeaderLen); err != nil {
+		return c.readFailed(err)
+	}
+	hdr := c.rawInput.Bytes()[:recordHeaderLen]
+	n := int(hdr[3])<<8 | int(hdr[4])
+	if n > maxCiphertext {
+		return c.setReadErr(fmt.Errorf("record: oversized record received with length %d", n))
+	}
+	if err := c.fill(recordHeaderLen + n); err != nil {
+		return c.readFailed(err)
+	}
+	typ, data, err := c.in.decrypt(c.rawInput.Next(recordHeaderLen + n))
+	if err != nil {
+		if errors.Is(err, errBadRecordMAC) {
+			c.sendAlert(alertBadRecordMAC)
+		}
+		return c.setReadErr(err)
+	}
+
+	switch typ {
+	case recordTypeApplicationData:
+		c.input.Reset(data)
+	case recordTypeHandshake:
+		c.hand.Write(data)
+	case recordTypeAlert:
+		if len(data) != 2 {
+			return c.setReadErr(errors.New("record: invalid alert"))
+		}
+		if data[1] == alertCloseNotify {
+			return c.setReadErr(io.EOF)
+		}
+		// TLS 1.2 warnings other than close notify are ignored
+		if c.version != tls.VersionTLS13 && data[0] == alertLevelWarning {
+			return nil
+		}
+		return c.setReadErr(fmt.Errorf("record: remote error: alert %d", data[1]))
+	default:
+		return c.setReadErr(fmt.Errorf("record: unexpected record type %d", typ))
+	}
+	return nil
+}
+
+// readFailed handles errors reading from the underlying conn, timeouts
+// aren't permanent
+func (c *Conn) readFailed(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return err
+	}
+	return c.setReadErr(err)
+}
+
+// fill reads from the underlying conn until rawInput contains n bytes
+func (c *Conn) fill(n int) error {
+	if need := n - c.rawInput.Len(); need > 0 {
+		c.rawInput.Grow(need)
+		_, err := c.rawInput.ReadFrom(&atLeastReader{R: c.conn, N: int64(need)})
+		if c.rawInput.Len() < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePostHandshake processes the complete handshake messages received,
+// inMu must be held
+func (c *Conn) handlePostHandshake() error {
+	for c.hand.Len() >= 4 {
+		b := c.hand.Bytes()
+		n := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if c.hand.Len() < 4+n {
+			return nil
+		}
+		typ, body := b[0], b[4:4+n]
+
+		switch {
+		case c.version == tls.VersionTLS13 && typ == typeNewSessionTicket:
+			// Session tickets can't be used without the handshake
+			// secrets, they are discarded
+		case c.version == tls.VersionTLS13 && typ == typeKeyUpdate:
+			if len(body) != 1 || body[0] > 1 {
+				return errors.New("record: invalid key update")
+			}
+			if err := c.in.updateTrafficSecret(); err != nil {
+				return err
+			}
+			if body[0] == 1 {
+				c.outMu.Lock()
+				err := c.sendKeyUpdateLocked(false)
+				c.outMu.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+		case c.version != tls.VersionTLS13 && typ == typeHelloRequest:
+			return errors.New("record: renegotiation not supported")
+		default:
+			return fmt.Errorf("record: unexpected handshake message type %d", typ)
+		}
+		c.hand.Next(4 + n)
+	}
+	return nil
+}
+
+// Write writes application data, split in records of the maximum size
+func (c *Conn) Write(b []byte) (int, error) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	if c.closeNotifySent {
+		return 0, errors.New("record: write after close")
+	}
+	var n int
+	for len(b) > 0 {
+		m := min(len(b), maxPlaintext)
+		if err := c.writeRecordLocked(recordTypeApplicationData, b[:m]); err != nil {
+			return n, err
+		}
+		n += m
+		b = b[m:]
+	}
+	return n, nil
+}
+
+// writeRecordLocked encrypts and writes a record, outMu must be held
+func (c *Conn) writeRecordLocked(typ byte, data []byte) error {
+	record, err := c.out.encrypt(typ, data)
+	if err != nil {
+		c.writeErr = err
+		return err
+	}
+	if _, err := c.conn.Write(record); err != nil {
+		c.writeErr = err
+		return err
+	}
+	return nil
+}
+
+// UpdateKey sends a TLS 1.3 KeyUpdate message and rotates the write traffic
+// secret. If requestPeer is true the peer is requested to rotate its write
+// traffic secret too.
+func (c *Conn) UpdateKey(requestPeer bool) error {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.version != tls.VersionTLS13 {
+		return fmt.Errorf("record: key update not supported in %s", tls.VersionName(c.version))
+	}
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	return c.sendKeyUpdateLocked(requestPeer)
+}
+
+// sendKeyUpdateLocked sends a key update message, outMu must be held
+func (c *Conn) sendKeyUpdateLocked(requestPeer bool) error {
+	var requested byte
+	if requestPeer {
+		requested = 1
+	}
+	if err := c.writeRecordLocked(recordTypeHandshake, []byte{typeKeyUpdate, 0, 0, 1, requested}); err != nil {
+		return err
+	}
+	if err := c.out.updateTrafficSecret(); err != nil {
+		c.writeErr = err
+		return err
+	}
+	return nil
+}
+
+// sendAlert sends a fatal alert, errors are ignored as the conn is already
+// failing
+func (c *Conn) sendAlert(desc byte) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.writeErr == nil {
+		_ = c.writeRecordLocked(recordTypeAlert, []byte{2, desc})
+	}
+}
+
+// Close sends a close notify alert and closes the underlying conn
+func (c *Conn) Close() error {
+	c.outMu.Lock()
+	var alertErr error
+	if !c.closeNotifySent && c.writeErr == nil {
+		c.closeNotifySent = true
+		// Don't block forever if the peer isn't reading
+		_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		alertErr = c.writeRecordLocked(recordTypeAlert, []byte{alertLevelWarning, alertCloseNotify})
+	}
+	c.outMu.Unlock()
+	if err := c.conn.Close(); err != nil {
+		return err
+	}
+	return alertErr
+}
+
+// LocalAddr returns the local network address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the underlying conn
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying conn
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying conn
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// atLeastReader reads from R, stopping with EOF once at least N bytes have
+// been read
+type atLeastReader struct {
+	R io.Reader
+	N int64
+}
+
+func (r *atLeastReader) Read(p []byte) (int, error) {
+	if r.N <= 0 {
+		return 0, io.EOF
+	}
+	n, err := r.R.Read(p)
+	r.N -= int64(n)
+	if r.N > 0 && err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if r.N <= 0 && err == nil {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// clone returns a copy of b
+func clone(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// cloneKeys returns a copy of keys
+func cloneKeys(k Keys) Keys {
+	return Keys{Key: clone(k.Key), IV: clone(k.IV), MAC: clone(k.MAC)}
+}
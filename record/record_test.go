@@ -0,0 +1,273 @@
+package record_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"go/build"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/igolaizola/resumetls"
+	"github.com/igolaizola/resumetls/record"
+)
+
+var suites = []struct {
+	name    string
+	version uint16
+	ciphers []uint16
+}{
+	{"TLS_AES_128_GCM_SHA256", tls.VersionTLS13, []uint16{tls.TLS_AES_128_GCM_SHA256}},
+	{"TLS_AES_256_GCM_SHA384", tls.VersionTLS13, []uint16{tls.TLS_AES_256_GCM_SHA384}},
+	{"TLS_CHACHA20_POLY1305_SHA256", tls.VersionTLS13, []uint16{tls.TLS_CHACHA20_POLY1305_SHA256}},
+	{"TLS_RSA_WITH_3DES_EDE_CBC_SHA", tls.VersionTLS12, []uint16{tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA}},
+	{"TLS_RSA_WITH_AES_128_CBC_SHA", tls.VersionTLS12, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}},
+	{"TLS_RSA_WITH_AES_128_CBC_SHA256", tls.VersionTLS12, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA256}},
+	{"TLS_RSA_WITH_AES_256_GCM_SHA384", tls.VersionTLS12, []uint16{tls.TLS_RSA_WITH_AES_256_GCM_SHA384}},
+	{"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA}},
+	{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+	{"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}},
+}
+
+// certificate returns a self signed RSA certificate, which is valid for all
+// the tested cipher suites
+var certificate = sync.OnceValues(func() (tls.Certificate, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+})
+
+func TestRecord(t *testing.T) {
+	for _, tt := range suites {
+		for _, client := range []bool{true, false} {
+			name := tt.name + "/Server"
+			if client {
+				name = tt.name + "/Client"
+			}
+			t.Run(name, func(t *testing.T) {
+				testRecord(t, client, tt.version, tt.ciphers)
+			})
+		}
+	}
+}
+
+func testRecord(t *testing.T, client bool, version uint16, ciphers []uint16) {
+	pair, err := certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliCfg := &tls.Config{
+		InsecureSkipVerify: true,
+		CipherSuites:       ciphers,
+		MinVersion:         version,
+		MaxVersion:         version,
+	}
+	srvCfg := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		CipherSuites: ciphers,
+		MinVersion:   version,
+		MaxVersion:   version,
+	}
+
+	// A TCP conn is used because key updates are answered while writing
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peerConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+
+	// Launch a crypto/tls echo peer
+	newConn := resumetls.Server
+	cfg := srvCfg
+	peer := tls.Client(peerConn, cliCfg)
+	if client {
+		newConn = resumetls.Client
+		cfg = cliCfg
+		peer = tls.Server(peerConn, srvCfg)
+	}
+	peerErr := make(chan error, 1)
+	go func() {
+		recv := make([]byte, 64*1024)
+		for {
+			n, err := peer.Read(recv)
+			if err != nil {
+				peerErr <- err
+				return
+			}
+			if _, err := peer.Write(recv[:n]); err != nil {
+				peerErr <- err
+				return
+			}
+		}
+	}()
+
+	c, err := newConn(conn, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, c, []byte("hello"))
+	state, err := c.CompactState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := state.RecordParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Continue the connection using the record layer
+	rc, err := record.New(conn, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, rc, []byte("hello"))
+	exchange(t, rc, bytes.Repeat([]byte("0123456789"), 4000))
+	if version == tls.VersionTLS13 {
+		if err := rc.UpdateKey(true); err != nil {
+			t.Fatal(err)
+		}
+		exchange(t, rc, []byte("updated"))
+		exchange(t, rc, []byte("updated twice"))
+	} else if err := rc.UpdateKey(false); err == nil {
+		t.Fatal("expected key update error")
+	}
+
+	// Data that wasn't read is kept in the params
+	if _, err := rc.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	recv := make([]byte, 5)
+	if _, err := io.ReadFull(rc, recv); err != nil {
+		t.Fatal(err)
+	}
+	rc, err = record.New(conn, rc.Params())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv = make([]byte, 6)
+	if _, err := io.ReadFull(rc, recv); err != nil {
+		t.Fatal(err)
+	}
+	if string(recv) != " world" {
+		t.Fatalf("unexpected pending data %q", recv)
+	}
+	exchange(t, rc, []byte("hello"))
+
+	// The peer receives a close notify
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-peerErr:
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer didn't receive close notify")
+	}
+}
+
+// exchange writes a message and checks it is echoed back
+func exchange(t *testing.T, c io.ReadWriter, message []byte) {
+	t.Helper()
+	if _, err := c.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	recv := make([]byte, len(message))
+	if _, err := io.ReadFull(c, recv); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, recv) {
+		t.Fatalf("messages mismatch: %q != %q", message, recv)
+	}
+}
+
+func TestRecordInvalid(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	iv := bytes.Repeat([]byte{2}, 12)
+	valid := record.Params{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+		In:          record.Keys{Key: key, IV: iv},
+		Out:         record.Keys{Key: key, IV: iv},
+	}
+	if _, err := record.New(nil, &valid); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		modify func(p *record.Params)
+	}{
+		{"version", func(p *record.Params) { p.Version = tls.VersionTLS11 }},
+		{"cipher suite", func(p *record.Params) { p.CipherSuite = tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 }},
+		{"key", func(p *record.Params) { p.In.Key = key[:8] }},
+		{"secret", func(p *record.Params) { p.InSecret = key }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid
+			tt.modify(&p)
+			if _, err := record.New(nil, &p); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+// TestImports checks that the record package doesn't depend on packages of
+// this module that use crypto/tls internals
+func TestImports(t *testing.T) {
+	const module = "github.com/igolaizola/resumetls"
+	seen := map[string]bool{}
+	var walk func(path string)
+	walk = func(path string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		dir := filepath.Join("..", strings.TrimPrefix(path, module))
+		pkg, err := build.ImportDir(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, imp := range pkg.Imports {
+			switch {
+			case imp == "unsafe" || imp == "reflect":
+				t.Errorf("%s imports %s", path, imp)
+			case strings.HasPrefix(imp, module+"/"):
+				walk(imp)
+			}
+		}
+	}
+	walk(module + "/record")
+}
@@ -2,15 +2,22 @@ package resumetls
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	intio "github.com/igolaizola/resumetls/internal/io"
 	intnet "github.com/igolaizola/resumetls/internal/net"
 	intref "github.com/igolaizola/resumetls/internal/reflect"
+	"github.com/igolaizola/resumetls/internal/suite"
 )
 
 // State is buffered handshake data
@@ -20,40 +27,133 @@ type State struct {
 	inSeq       [8]byte
 	outSeq      [8]byte
 	cipherSuite uint16
+	version     uint16
+	inKeys      suite.Keys
+	outKeys     suite.Keys
+
+	verifiedChains  [][][]byte
+	serverName      string
+	certFingerprint []byte
+	role            Role
+	pending         buffers
+	inSecret        []byte
+	outSecret       []byte
+
+	session          []byte
+	tickets          [][]byte
+	handshakeTimes   []int64
+	resumptionSecret []byte
+	keyLog           []byte
 }
 
 // Conn resumable tls conn
 type Conn struct {
-	handshaked   bool
+	role         Role
+	handshakeMu  sync.Mutex
+	handshaked   atomic.Bool
+	gate         pauseGate
+	compact      bool
 	overrideRand *intio.OverrideReader
 	overrideConn *intnet.OverrideConn
 	connBuffer   *bytes.Buffer
 	randBuffer   *bytes.Buffer
+	sentBuffer   *bytes.Buffer
+	keyLogBuffer *bytes.Buffer
+	keyLog       []byte
+	keys         *trafficKeys
+	keysErr      error
+	certs        *certCapture
+	sessions     *sessionCapture
+	onClose      func()
+	checkpoints  *checkpointer
+	wal          *wal
 	*tls.Conn
 }
 
-// Client returns a resumable tls client conn
-func Client(conn net.Conn, cfg *tls.Config, state *State) (*Conn, error) {
-	return newConn(tls.Client, conn, cfg, state)
+// Client returns a resumable tls client conn.
+// The config is cloned, so a single tls.Config can be shared by any number of
+// concurrent connections. The only change to the config is the initialization
+// of its automatic session ticket keys, which crypto/tls does as well.
+func Client(conn net.Conn, cfg *tls.Config, state *State, opts ...Option) (*Conn, error) {
+	return ClientContext(context.Background(), conn, cfg, state, opts...)
+}
+
+// ClientContext returns a resumable tls client conn.
+// When a state is provided, the replayed handshake is interrupted if the
+// context is done before it completes and conn is closed as in
+// tls.Conn.HandshakeContext.
+func ClientContext(ctx context.Context, conn net.Conn, cfg *tls.Config, state *State, opts ...Option) (*Conn, error) {
+	return newConn(ctx, RoleClient, conn, cfg, state, newOptions(opts))
 }
 
-// Server returns a resumable tls server conn
-func Server(conn net.Conn, cfg *tls.Config, state *State) (*Conn, error) {
-	return newConn(tls.Server, conn, cfg, state)
+// Server returns a resumable tls server conn.
+// The config is cloned, so a single tls.Config can be shared by any number of
+// concurrent connections. The only change to the config is the initialization
+// of its automatic session ticket keys, which crypto/tls does as well.
+func Server(conn net.Conn, cfg *tls.Config, state *State, opts ...Option) (*Conn, error) {
+	return ServerContext(context.Background(), conn, cfg, state, opts...)
+}
+
+// ServerContext returns a resumable tls server conn.
+// When a state is provided, the replayed handshake is interrupted if the
+// context is done before it completes and conn is closed as in
+// tls.Conn.HandshakeContext.
+func ServerContext(ctx context.Context, conn net.Conn, cfg *tls.Config, state *State, opts ...Option) (*Conn, error) {
+	return newConn(ctx, RoleServer, conn, cfg, state, newOptions(opts))
 }
 
 // newConn returns a resumable tls conn
-func newConn(tlsConn func(net.Conn, *tls.Config) *tls.Conn, conn net.Conn, cfg *tls.Config, state *State) (*Conn, error) {
-	if state != nil {
-		return resume(tlsConn, conn, cfg, state)
+func newConn(ctx context.Context, role Role, conn net.Conn, cfg *tls.Config, state *State, opts *options) (*Conn, error) {
+	if runtimeErr != nil {
+		return nil, runtimeErr
+	}
+	cfg = cloneConfig(cfg)
+	var w *wal
+	if opts.wal != "" {
+		w = newWAL(opts.wal)
+		conn = &walConn{Conn: conn, wal: w}
+	}
+	var c *Conn
+	switch {
+	case state == nil:
+		c = initialize(role, conn, cfg)
+	case state.role != 0 && state.role != role:
+		return nil, fmt.Errorf("%w: %s state resumed as %s", ErrRoleMismatch, state.role, role)
+	case state.compact():
+		var err error
+		if c, err = restore(role, conn, cfg, state); err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		if c, err = resume(ctx, role, conn, cfg, state, opts); err != nil {
+			return nil, err
+		}
 	}
-	return initialize(tlsConn, conn, cfg), nil
+	if w != nil {
+		w.attach(c.Conn)
+		c.wal = w
+		// Resumed conns log from the state they were resumed from
+		if state != nil {
+			state, err := c.state()
+			if err != nil {
+				return nil, err
+			}
+			if err := w.start(state); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.checkpoints = startCheckpoints(c, opts.checkpoint)
+	return c, nil
 }
 
 // initializes a resumable TLS client conn
-func initialize(tlsConn func(net.Conn, *tls.Config) *tls.Conn, conn net.Conn, cfg *tls.Config) *Conn {
+func initialize(role Role, conn net.Conn, cfg *tls.Config) *Conn {
 	connBuf := &bytes.Buffer{}
 	randBuf := &bytes.Buffer{}
+	sentBuf := &bytes.Buffer{}
+	keyLogBuf := &bytes.Buffer{}
 
 	rnd := cfg.Rand
 	if rnd == nil {
@@ -75,20 +175,35 @@ func initialize(tlsConn func(net.Conn, *tls.Config) *tls.Conn, conn net.Conn, cf
 	ovConn := &intnet.OverrideConn{
 		Conn:           conn,
 		OverrideReader: io.TeeReader(conn, connBuf),
+		OverrideWriter: io.MultiWriter(conn, sentBuf),
 	}
 
 	cfg.Rand = ovRand
+	cfg.KeyLogWriter = teeKeyLog(cfg.KeyLogWriter, keyLogBuf)
+	certs := &certCapture{}
+	certs.wrap(cfg)
+	sessions := &sessionCapture{recording: true}
+	sessions.wrap(cfg)
 	return &Conn{
+		role:         role,
 		overrideConn: ovConn,
 		overrideRand: ovRand,
 		connBuffer:   connBuf,
 		randBuffer:   randBuf,
-		Conn:         tlsConn(ovConn, cfg),
+		sentBuffer:   sentBuf,
+		keyLogBuffer: keyLogBuf,
+		certs:        certs,
+		sessions:     sessions,
+		Conn:         newTLSConn(role, ovConn, cfg),
 	}
 }
 
 // resume resumes a resumable TLS client conn
-func resume(tlsConn func(net.Conn, *tls.Config) *tls.Conn, conn net.Conn, cfg *tls.Config, state *State) (*Conn, error) {
+func resume(ctx context.Context, role Role, conn net.Conn, cfg *tls.Config, state *State, opts *options) (*Conn, error) {
+	verifiedChains, err := parseChains(state.verifiedChains)
+	if err != nil {
+		return nil, corruptError(fmt.Errorf("couldn't parse verified chains: %w", err))
+	}
 	rnd := cfg.Rand
 	if rnd == nil {
 		rnd = rand.Reader
@@ -106,56 +221,258 @@ func resume(tlsConn func(net.Conn, *tls.Config) *tls.Conn, conn net.Conn, cfg *t
 		OverrideReader: io.MultiReader(stateRandReader, rnd),
 		Reader:         rnd,
 	}
+	// Handshake writes are discarded, they are only kept to obtain key
+	// material
+	sentBuf := &bytes.Buffer{}
+	keyLogBuf := &bytes.Buffer{}
 	ovConn := &intnet.OverrideConn{
 		Conn:           conn,
 		OverrideReader: io.MultiReader(bytes.NewBuffer(state.conn), conn),
-		OverrideWriter: io.Discard,
+		OverrideWriter: sentBuf,
 	}
 	cfg.Rand = ovRand
+	// The key log was written by the original handshake, the replay only
+	// captures it to obtain key material
+	cfg.KeyLogWriter = keyLogBuf
+	certs := &certCapture{expected: state.certFingerprint, resuming: true}
+	certs.wrap(cfg)
+	// The session offered and the time readings of the original handshake
+	// are replayed, so the client hello is the same
+	sessions := &sessionCapture{
+		replaying: true,
+		times:     state.handshakeTimes,
+		session:   state.session,
+		tickets:   slices.Clone(state.tickets),
+	}
+	sessions.wrap(cfg)
 
-	c := tlsConn(ovConn, cfg)
-	if err := c.Handshake(); err != nil {
+	// The peer certificates were verified by the original handshake, so
+	// verification is skipped during the replay unless requested
+	replayCfg := cfg
+	if !opts.reverify {
+		replayCfg = skipVerifyConfig(cfg)
+	}
+
+	if err := state.checkTranscript(role); err != nil {
+		return nil, err
+	}
+	if err := state.checkConfig(cfg, role); err != nil {
 		return nil, err
 	}
+	c := newTLSConn(role, ovConn, replayCfg)
+	if err := c.HandshakeContext(ctx); err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrStateMismatch) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: replayed handshake failed: %w", ErrStateMismatch, err)
+	}
+	certs.resuming = false
+	sessions.finish()
 	ovRand.OverrideReader = nil
 	ovConn.OverrideReader = nil
 	ovConn.OverrideWriter = nil
+	// Traffic secrets may have been updated after the handshake
+	if len(state.inSecret) > 0 {
+		s, err := suite.Lookup(state.version, state.cipherSuite)
+		if err != nil {
+			return nil, corruptError(err)
+		}
+		if err := setTrafficSecrets(c, s, state.inSecret, state.outSecret); err != nil {
+			return nil, corruptError(err)
+		}
+	}
 	setState(c, state.inSeq, state.outSeq, state.cipherSuite)
+	setBuffers(c, state.pending)
+	if !opts.reverify {
+		setConfig(c, cfg)
+		setVerifiedChains(c, verifiedChains)
+	}
 
-	return &Conn{
-		handshaked: true,
-		connBuffer: bytes.NewBuffer(state.conn),
-		randBuffer: bytes.NewBuffer(state.rand),
-		Conn:       c,
-	}, nil
+	rc := &Conn{
+		role:         role,
+		connBuffer:   bytes.NewBuffer(state.conn),
+		randBuffer:   bytes.NewBuffer(state.rand),
+		sentBuffer:   sentBuf,
+		keyLogBuffer: keyLogBuf,
+		keyLog:       state.keyLog,
+		certs:        certs,
+		sessions:     sessions,
+		Conn:         c,
+	}
+	rc.handshaked.Store(true)
+	rc.establishKeys()
+	return rc, nil
 }
 
 // Handshake overrides tls handshakes
 func (c *Conn) Handshake() error {
-	if c.handshaked {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext overrides tls handshakes.
+// Handshake data capture is finalized once the handshake is completed.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	if c.handshaked.Load() {
 		return nil
 	}
-	if err := c.Conn.Handshake(); err != nil {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.handshaked.Load() {
+		return nil
+	}
+	if err := c.Conn.HandshakeContext(ctx); err != nil {
 		c.connBuffer = &bytes.Buffer{}
 		c.randBuffer = &bytes.Buffer{}
 		return err
 	}
-	c.handshaked = true
+	c.sessions.finish()
+	// Data received along with the last handshake messages isn't part of
+	// the handshake, it is kept in the tls conn input buffer
+	if n := c.connBuffer.Len() - rawInputLen(c.Conn); n >= 0 {
+		c.connBuffer.Truncate(n)
+	}
 	c.overrideRand.OverrideReader = nil
 	c.overrideConn.OverrideReader = nil
+	c.overrideConn.OverrideWriter = nil
+	c.establishKeys()
+	// The flag is set once the capture is finalized, so it can be checked
+	// without waiting for a handshake in progress
+	c.handshaked.Store(true)
+	if c.wal != nil {
+		state, err := c.state()
+		if err != nil {
+			return err
+		}
+		return c.wal.start(state)
+	}
 	return nil
 }
 
-// State gets the data in order to resume a connection
+// isHandshaked returns whether the handshake has been completed, without
+// waiting for a handshake in progress
+func (c *Conn) isHandshaked() bool {
+	return c.handshaked.Load()
+}
+
+// Read overrides tls reads to complete the handshake first, so application
+// data is never captured as handshake data
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	for {
+		if err := c.gate.enter(&c.gate.reads); err != nil {
+			return 0, err
+		}
+		seq := c.checkpoints.seq("in")
+		n, err := c.Conn.Read(b)
+		if !c.gate.exitRead(n, err) {
+			c.checkpoints.count("in", seq, n)
+			if lerr := c.logProgress(); lerr != nil && err == nil {
+				err = lerr
+			}
+			return n, err
+		}
+	}
+}
+
+// Write overrides tls writes to complete the handshake first, so application
+// data is never captured as handshake data
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if err := c.gate.enter(&c.gate.writes); err != nil {
+		return 0, err
+	}
+	if c.wal != nil {
+		if err := c.wal.logData(b); err != nil {
+			if c.gate.exitWrite() {
+				c.checkpoints.signal()
+			}
+			return 0, err
+		}
+	}
+	seq := c.checkpoints.seq("out")
+	n, err := c.Conn.Write(b)
+	if c.wal != nil && err == nil {
+		// The data was sent, but the log failed and so will later writes
+		err = c.wal.logWritten()
+	}
+	retry := c.gate.exitWrite()
+	c.checkpoints.count("out", seq, n)
+	if retry {
+		c.checkpoints.signal()
+	}
+	return n, err
+}
+
+// cloneConfig returns a copy of cfg that can be modified without affecting
+// other connections. Session tickets are still wrapped using the ticket keys
+// of the original config, so they stay valid across connections sharing it.
+func cloneConfig(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		return &tls.Config{}
+	}
+	// Servers initialize the session ticket keys of the config they handshake
+	// with, reading from the config Rand. They are initialized in the
+	// original config first, so the clone inherits them and the handshake
+	// doesn't consume random bytes that a replay wouldn't consume. They are
+	// shared by every conn of the config, as with crypto/tls, so initializing
+	// them in a clone would break resumption across conns.
+	_, _ = cfg.DecryptTicket(nil, tls.ConnectionState{})
+	clone := cfg.Clone()
+	if cfg.WrapSession == nil {
+		clone.WrapSession = cfg.EncryptTicket
+	}
+	if cfg.UnwrapSession == nil {
+		clone.UnwrapSession = cfg.DecryptTicket
+	}
+	return clone
+}
+
+// State gets the data in order to resume a connection.
+// Connections restored from a compact state return a compact state.
+// Received data that hasn't been read yet is included in the state and
+// delivered by the resumed connection before reading from the network.
 func (c *Conn) State() *State {
+	state, err := c.state()
+	if err != nil {
+		// Compact states of compact connections don't fail once resumed
+		panic(fmt.Sprintf("resumetls: couldn't get compact state: %v", err))
+	}
+	return state
+}
+
+// state gets the data in order to resume a connection, failing only if the
+// compact state of a compact connection can't be obtained
+func (c *Conn) state() (*State, error) {
+	if c.compact {
+		return c.CompactState()
+	}
 	in, out, cipherSuite := getState(c.Conn)
+	cs := c.Conn.ConnectionState()
+	inSecret, outSecret := getTrafficSecrets(c.Conn)
+	session, tickets, times := c.sessions.snapshot()
 	return &State{
-		conn:        c.connBuffer.Bytes(),
-		rand:        c.randBuffer.Bytes(),
-		inSeq:       in,
-		outSeq:      out,
-		cipherSuite: cipherSuite,
-	}
+		conn:            c.connBuffer.Bytes(),
+		rand:            c.randBuffer.Bytes(),
+		inSeq:           in,
+		outSeq:          out,
+		cipherSuite:     cipherSuite,
+		version:         getVersion(c.Conn),
+		verifiedChains:  rawChains(cs.VerifiedChains),
+		serverName:      cs.ServerName,
+		certFingerprint: c.certs.fingerprint,
+		role:            c.role,
+		pending:         getBuffers(c.Conn),
+		inSecret:        cloneBytes(inSecret),
+		outSecret:       cloneBytes(outSecret),
+		session:         session,
+		tickets:         tickets,
+		handshakeTimes:  times,
+		keyLog:          c.keyLog,
+	}, nil
 }
 
 // setState override sequence numbers and cipher suite
@@ -172,12 +489,18 @@ func setState(conn *tls.Conn, in [8]byte, out [8]byte, cipherSuite uint16) {
 // getState obtains sequence numbers and cipher suite
 func getState(conn *tls.Conn) ([8]byte, [8]byte, uint16) {
 	r := reflect.ValueOf(conn).Elem()
-	fIn := r.FieldByName("in")
-	in := intref.FieldToInterface(fIn, "seq").([8]byte)
-
-	fOut := r.FieldByName("out")
-	out := intref.FieldToInterface(fOut, "seq").([8]byte)
 	cipherSuite := intref.FieldToInterface(r, "cipherSuite").(uint16)
+	return getSeq(conn, "in"), getSeq(conn, "out"), cipherSuite
+}
 
-	return in, out, cipherSuite
+// getSeq obtains the sequence number of the "in" or "out" half conn
+func getSeq(conn *tls.Conn, half string) [8]byte {
+	r := reflect.ValueOf(conn).Elem()
+	return intref.FieldToInterface(r.FieldByName(half), "seq").([8]byte)
+}
+
+// halfMutex returns the mutex of the "in" or "out" half conn
+func halfMutex(conn *tls.Conn, half string) *sync.Mutex {
+	r := reflect.ValueOf(conn).Elem()
+	return (*sync.Mutex)(intref.FieldPointer(r.FieldByName(half), "Mutex"))
 }
@@ -2,9 +2,15 @@ package resumetls
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sync"
 	"testing"
+	"time"
 )
 
 var cert = `-----BEGIN CERTIFICATE-----
@@ -360,3 +366,243 @@ func testServer(t *testing.T, ciphers []uint16) {
 		t.Errorf("messages missmatch: %s != %s", message, recv[:n])
 	}
 }
+
+func TestSharedConfig(t *testing.T) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliCfg := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	srvCfg := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+	}
+
+	n := 1000
+	if testing.Short() {
+		n = 100
+	}
+	var wg sync.WaitGroup
+	errC := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		sConn, cConn := net.Pipe()
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer cConn.Close()
+			errC <- testSharedConfig(Client, cConn, cliCfg, true)
+		}()
+		go func() {
+			defer wg.Done()
+			defer sConn.Close()
+			errC <- testSharedConfig(Server, sConn, srvCfg, false)
+		}()
+	}
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The shared configs must be left untouched
+	for _, cfg := range []*tls.Config{cliCfg, srvCfg} {
+		if cfg.Rand != nil || cfg.KeyLogWriter != nil {
+			t.Fatal("shared config was modified")
+		}
+	}
+}
+
+func TestSharedConfigTicketKeys(t *testing.T) {
+	// The first handshake of a fresh server config initializes its session
+	// ticket keys, the replay must consume the same random bytes
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		t.Run(tls.VersionName(version), func(t *testing.T) {
+			cliCfg := &tls.Config{InsecureSkipVerify: true, MaxVersion: version}
+			srvCfg := &tls.Config{Certificates: []tls.Certificate{newCertificate(t)}}
+			sConn, cConn := net.Pipe()
+			defer sConn.Close()
+			defer cConn.Close()
+			errC := make(chan error, 1)
+			go func() {
+				errC <- testSharedConfig(Client, cConn, cliCfg, true)
+			}()
+			if err := testSharedConfig(Server, sConn, srvCfg, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errC; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// testSharedConfig handshakes, pauses and resumes a conn using a shared config
+// and then exchanges messages with the peer.
+// The client side writes first and the server side echoes.
+func testSharedConfig(newConn func(net.Conn, *tls.Config, *State, ...Option) (*Conn, error), conn net.Conn, cfg *tls.Config, client bool) error {
+	c, err := newConn(conn, cfg, nil)
+	if err != nil {
+		return err
+	}
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			// Resume with the same shared config
+			if c, err = newConn(conn, cfg, c.State()); err != nil {
+				return err
+			}
+		}
+		message := []byte("Hello")
+		recv := make([]byte, 1024)
+		if client {
+			if _, err := c.Write(message); err != nil {
+				return err
+			}
+		}
+		n, err := c.Read(recv)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(message, recv[:n]) {
+			return fmt.Errorf("messages missmatch: %s != %s", message, recv[:n])
+		}
+		if !client {
+			if _, err := c.Write(recv[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestImplicitHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		greeting bool
+		trigger  func(c *Conn) error
+	}{
+		{"Read", true, func(c *Conn) error {
+			recv := make([]byte, 1024)
+			_, err := c.Read(recv)
+			return err
+		}},
+		{"Write", false, func(c *Conn) error {
+			_, err := c.Write([]byte("Hello"))
+			if err != nil {
+				return err
+			}
+			recv := make([]byte, 1024)
+			_, err = c.Read(recv)
+			return err
+		}},
+		{"HandshakeContext", false, func(c *Conn) error {
+			return c.HandshakeContext(context.Background())
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testImplicitHandshake(t, tt.greeting, tt.trigger)
+		})
+	}
+}
+
+func testImplicitHandshake(t *testing.T, greeting bool, trigger func(c *Conn) error) {
+	sConn, cConn := net.Pipe()
+	defer sConn.Close()
+	defer cConn.Close()
+
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := tls.Server(sConn, &tls.Config{
+		Certificates: []tls.Certificate{pair},
+	})
+
+	// Launch echo server in another goroutine
+	go func() {
+		if greeting {
+			if _, err := srv.Write([]byte("Hello")); err != nil {
+				return
+			}
+		}
+		recv := make([]byte, 1024)
+		for {
+			n, err := srv.Read(recv)
+			if err != nil {
+				return
+			}
+			if _, err := srv.Write(recv[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	cli, err := Client(cConn, &tls.Config{
+		InsecureSkipVerify: true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trigger(cli); err != nil {
+		t.Fatal(err)
+	}
+
+	// Application data must not be captured
+	captured := cli.connBuffer.Len()
+	echo(t, cli)
+	echo(t, cli)
+	if cli.connBuffer.Len() != captured {
+		t.Fatalf("application data captured: %d != %d", cli.connBuffer.Len(), captured)
+	}
+
+	cli2, err := Client(cConn, &tls.Config{
+		InsecureSkipVerify: true,
+	}, cli.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, cli2)
+}
+
+func TestHandshakeContext(t *testing.T) {
+	t.Run("Handshake", func(t *testing.T) {
+		// The peer never answers
+		sConn, cConn := net.Pipe()
+		defer sConn.Close()
+		defer cConn.Close()
+		go io.Copy(io.Discard, sConn)
+
+		cli, err := Client(cConn, &tls.Config{
+			InsecureSkipVerify: true,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := cli.HandshakeContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	})
+	t.Run("Resume", func(t *testing.T) {
+		state, cConn := pausedClient(t, nil)
+		defer cConn.Close()
+
+		// A truncated handshake makes the replay wait for data from the peer
+		state.conn = state.conn[:len(state.conn)/2]
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := ClientContext(ctx, cConn, &tls.Config{
+			InsecureSkipVerify: true,
+		}, state)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// Role is the role of a conn in the handshake
+type Role uint8
+
+const (
+	// RoleClient is the role of conns created with Client
+	RoleClient Role = iota + 1
+	// RoleServer is the role of conns created with Server
+	RoleServer
+)
+
+// String returns the role name
+func (r Role) String() string {
+	switch r {
+	case RoleClient:
+		return "client"
+	case RoleServer:
+		return "server"
+	default:
+		return fmt.Sprintf("Role(%d)", uint8(r))
+	}
+}
+
+// parseRole decodes a role name as returned by Role.String
+func parseRole(name string) (Role, bool) {
+	for _, r := range []Role{RoleClient, RoleServer} {
+		if r.String() == name {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// newTLSConn returns a tls conn for the role
+func newTLSConn(role Role, conn net.Conn, cfg *tls.Config) *tls.Conn {
+	if role == RoleClient {
+		return tls.Client(conn, cfg)
+	}
+	return tls.Server(conn, cfg)
+}
+
+// Role returns the role of the conn the state was obtained from.
+// It returns zero if the role is unknown.
+func (s *State) Role() Role {
+	return s.role
+}
@@ -0,0 +1,76 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestStateRole(t *testing.T) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliCfg := &tls.Config{InsecureSkipVerify: true}
+	srvCfg := &tls.Config{Certificates: []tls.Certificate{pair}}
+
+	for _, role := range []Role{RoleClient, RoleServer} {
+		t.Run(role.String(), func(t *testing.T) {
+			var c *Conn
+			var conn net.Conn
+			other := Client
+			otherCfg := cliCfg
+			if role == RoleClient {
+				c, conn = handshakedConn(t, true, cliCfg, srvCfg)
+				other, otherCfg = Server, srvCfg
+			} else {
+				c, conn = handshakedConn(t, false, srvCfg, cliCfg)
+			}
+			compact, err := c.CompactState()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, state := range []*State{c.State(), compact} {
+				if state.Role() != role {
+					t.Fatalf("expected role %s, got %s", role, state.Role())
+				}
+
+				// The role survives serialization
+				data, err := state.MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var fromBinary State
+				if err := fromBinary.UnmarshalBinary(data); err != nil {
+					t.Fatal(err)
+				}
+				js, err := json.Marshal(state)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var fromJSON State
+				if err := json.Unmarshal(js, &fromJSON); err != nil {
+					t.Fatal(err)
+				}
+				for _, s := range []*State{&fromBinary, &fromJSON} {
+					if s.Role() != role {
+						t.Fatalf("expected role %s, got %s", role, s.Role())
+					}
+					if _, err := other(conn, otherCfg, s); !errors.Is(err, ErrRoleMismatch) {
+						t.Fatalf("expected role mismatch, got %v", err)
+					}
+				}
+			}
+
+			// States without role are checked using the transcript
+			state := c.State()
+			state.role = 0
+			if _, err := other(conn, otherCfg, state); !errors.Is(err, ErrRoleMismatch) {
+				t.Fatalf("expected role mismatch, got %v", err)
+			}
+		})
+	}
+}
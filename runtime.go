@@ -0,0 +1,113 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/igolaizola/resumetls/internal/tlscipher"
+)
+
+// ErrUnsupportedRuntime is returned when creating a conn if the crypto/tls
+// internals of the running Go version don't match the ones resumetls relies
+// on
+var ErrUnsupportedRuntime = errors.New("resumetls: unsupported go runtime")
+
+// fieldSpec is an unexported field accessed by resumetls along with its type.
+// A nil type is used for struct fields whose layout is checked separately.
+type fieldSpec struct {
+	name string
+	typ  reflect.Type
+}
+
+// connLayout are the crypto/tls.Conn fields accessed by resumetls
+var connLayout = []fieldSpec{
+	{"conn", reflect.TypeFor[net.Conn]()},
+	{"isClient", reflect.TypeFor[bool]()},
+	{"isHandshakeComplete", reflect.TypeFor[atomic.Bool]()},
+	{"vers", reflect.TypeFor[uint16]()},
+	{"haveVers", reflect.TypeFor[bool]()},
+	{"config", reflect.TypeFor[*tls.Config]()},
+	{"handshakes", reflect.TypeFor[int]()},
+	{"cipherSuite", reflect.TypeFor[uint16]()},
+	{"verifiedChains", reflect.TypeFor[[][]*x509.Certificate]()},
+	{"serverName", reflect.TypeFor[string]()},
+	{"ekm", reflect.TypeFor[func(string, []byte, int) ([]byte, error)]()},
+	{"resumptionSecret", reflect.TypeFor[[]byte]()},
+	{"in", nil},
+	{"out", nil},
+	{"rawInput", reflect.TypeFor[bytes.Buffer]()},
+	{"input", reflect.TypeFor[bytes.Reader]()},
+	{"hand", reflect.TypeFor[bytes.Buffer]()},
+}
+
+// halfConnLayout are the crypto/tls.halfConn fields accessed by resumetls
+var halfConnLayout = []fieldSpec{
+	{"Mutex", reflect.TypeFor[sync.Mutex]()},
+	{"version", reflect.TypeFor[uint16]()},
+	{"cipher", reflect.TypeFor[any]()},
+	{"mac", reflect.TypeFor[hash.Hash]()},
+	{"seq", reflect.TypeFor[[8]byte]()},
+	{"trafficSecret", reflect.TypeFor[[]byte]()},
+}
+
+// sessionStateLayout are the crypto/tls.SessionState fields accessed by
+// resumetls
+var sessionStateLayout = []fieldSpec{
+	{"secret", reflect.TypeFor[[]byte]()},
+}
+
+// runtimeErr is the result of checking the crypto/tls internals of the
+// running Go version, it is checked once at init
+var runtimeErr = checkRuntime()
+
+// checkRuntime checks that the crypto/tls internals match the expected layout
+func checkRuntime() error {
+	connType := reflect.TypeFor[tls.Conn]()
+	if err := checkLayout(connType, connLayout); err != nil {
+		return runtimeError(err)
+	}
+	for _, name := range []string{"in", "out"} {
+		f, _ := connType.FieldByName(name)
+		if f.Type.Kind() != reflect.Struct {
+			return runtimeError(fmt.Errorf("%s.%s is %s, want struct", connType, name, f.Type))
+		}
+		if err := checkLayout(f.Type, halfConnLayout); err != nil {
+			return runtimeError(err)
+		}
+	}
+	if err := checkLayout(reflect.TypeFor[tls.SessionState](), sessionStateLayout); err != nil {
+		return runtimeError(err)
+	}
+	if err := tlscipher.CheckRuntime(); err != nil {
+		return runtimeError(err)
+	}
+	return nil
+}
+
+// checkLayout checks that a struct type has the expected fields
+func checkLayout(typ reflect.Type, fields []fieldSpec) error {
+	for _, spec := range fields {
+		f, ok := typ.FieldByName(spec.name)
+		if !ok {
+			return fmt.Errorf("%s.%s not found", typ, spec.name)
+		}
+		if spec.typ != nil && f.Type != spec.typ {
+			return fmt.Errorf("%s.%s is %s, want %s", typ, spec.name, f.Type, spec.typ)
+		}
+	}
+	return nil
+}
+
+// runtimeError returns an error wrapping ErrUnsupportedRuntime
+func runtimeError(err error) error {
+	return fmt.Errorf("%w %s: %w", ErrUnsupportedRuntime, runtime.Version(), err)
+}
@@ -0,0 +1,48 @@
+package resumetls
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRuntime(t *testing.T) {
+	if err := checkRuntime(); err != nil {
+		t.Fatal(err)
+	}
+
+	type halfConn struct {
+		seq [4]byte
+	}
+	type conn struct {
+		vers uint16
+		in   halfConn
+	}
+	tests := []struct {
+		name   string
+		fields []fieldSpec
+	}{
+		{"missing", []fieldSpec{{"cipherSuite", reflect.TypeFor[uint16]()}}},
+		{"type", []fieldSpec{{"vers", reflect.TypeFor[uint8]()}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkLayout(reflect.TypeFor[conn](), tt.fields)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !errors.Is(runtimeError(err), ErrUnsupportedRuntime) {
+				t.Fatalf("expected unsupported runtime error: %v", err)
+			}
+		})
+	}
+	t.Run("nested", func(t *testing.T) {
+		if err := checkLayout(reflect.TypeFor[conn](), []fieldSpec{{"in", nil}}); err != nil {
+			t.Fatal(err)
+		}
+		f, _ := reflect.TypeFor[conn]().FieldByName("in")
+		if err := checkLayout(f.Type, halfConnLayout); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package resumetls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// sealedMagic prefixes every sealed state
+var sealedMagic = [4]byte{'R', 'T', 'L', 'E'}
+
+// sealedVersion is the current sealed state format version
+const sealedVersion = 1
+
+// ErrKeyNotFound is returned by key providers when a key id is unknown
+var ErrKeyNotFound = errors.New("resumetls: key not found")
+
+// ErrSealedState is returned when a sealed state is malformed or can't be
+// authenticated
+var ErrSealedState = errors.New("resumetls: invalid sealed state")
+
+// KeyProvider provides AES keys (16, 24 or 32 bytes) to seal and open states
+type KeyProvider interface {
+	// CurrentKey returns the key used to seal new states along with its id
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key for the given id, or ErrKeyNotFound
+	Key(id string) ([]byte, error)
+}
+
+// SealState encrypts and authenticates a state using AES-GCM with the current
+// key of the provider.
+//
+// The sealed format is the magic "RTLE", a version byte, the key id prefixed
+// by its length byte, a random nonce and the ciphertext. The header is
+// authenticated as additional data.
+func SealState(state *State, keys KeyProvider) ([]byte, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("resumetls: couldn't get current key: %w", err)
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("resumetls: key id too long (%d bytes)", len(id))
+	}
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := state.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(sealedMagic)+2+len(id)+aead.NonceSize())
+	header = append(header, sealedMagic[:]...)
+	header = append(header, sealedVersion, byte(len(id)))
+	header = append(header, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("resumetls: couldn't generate nonce: %w", err)
+	}
+	header = append(header, nonce...)
+
+	return aead.Seal(header, nonce, plaintext, header), nil
+}
+
+// OpenState decrypts and authenticates a state sealed by SealState, looking
+// up the key by the id stored in the blob
+func OpenState(blob []byte, keys KeyProvider) (*State, error) {
+	if len(blob) < len(sealedMagic)+2 || [4]byte(blob[:4]) != sealedMagic {
+		return nil, fmt.Errorf("%w: bad header", ErrSealedState)
+	}
+	if v := int(blob[4]); v != sealedVersion {
+		return nil, &StateVersionError{Version: v}
+	}
+	idLen := int(blob[5])
+	rest := blob[6:]
+	if len(rest) < idLen {
+		return nil, fmt.Errorf("%w: truncated key id", ErrSealedState)
+	}
+	id := string(rest[:idLen])
+	rest = rest[idLen:]
+
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("resumetls: couldn't get key %q: %w", id, err)
+	}
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: truncated ciphertext", ErrSealedState)
+	}
+	nonce := rest[:aead.NonceSize()]
+	ciphertext := rest[aead.NonceSize():]
+	header := blob[:len(blob)-len(ciphertext)]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSealedState, err)
+	}
+	state := &State{}
+	if err := state.UnmarshalBinary(plaintext); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// newSealAEAD returns the AEAD used to seal states
+func newSealAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("resumetls: invalid seal key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyRing is a concurrency safe KeyProvider supporting key rotation.
+// New states are sealed with the last added key and every key still present
+// in the ring can be used to open states.
+type KeyRing struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing returns a key ring with an initial key
+func NewKeyRing(id string, key []byte) (*KeyRing, error) {
+	r := &KeyRing{keys: map[string][]byte{}}
+	if err := r.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rotate adds a key to the ring and makes it the current one
+func (r *KeyRing) Rotate(id string, key []byte) error {
+	if len(id) > 255 {
+		return fmt.Errorf("resumetls: key id too long (%d bytes)", len(id))
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("resumetls: invalid seal key: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[id] = append([]byte{}, key...)
+	r.current = id
+	return nil
+}
+
+// Remove removes a key from the ring, states sealed with it can't be opened
+// anymore. The current key can't be removed.
+func (r *KeyRing) Remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id == r.current {
+		return fmt.Errorf("resumetls: can't remove current key %q", id)
+	}
+	delete(r.keys, id)
+	return nil
+}
+
+// CurrentKey implements KeyProvider.CurrentKey
+func (r *KeyRing) CurrentKey() (string, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current, r.keys[r.current], nil
+}
+
+// Key implements KeyProvider.Key
+func (r *KeyRing) Key(id string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
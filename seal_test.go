@@ -0,0 +1,69 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"testing"
+)
+
+func TestSealState(t *testing.T) {
+	state, cConn := pausedClient(t, nil)
+	defer cConn.Close()
+
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob1, err := SealState(state, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(blob1, state.rand) {
+		t.Fatal("sealed state contains plaintext rand")
+	}
+
+	// Rotate the key, old states can still be opened
+	if err := keys.Rotate("k2", bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	blob2, err := SealState(state, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenState(blob1, keys); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenState(blob2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Removed keys can't open states anymore
+	if err := keys.Remove("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenState(blob1, keys); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := keys.Remove("k2"); err == nil {
+		t.Fatal("expected error removing current key")
+	}
+
+	// Tampered states are rejected
+	for _, i := range []int{5, 8, len(blob2) - 1} {
+		tampered := append([]byte{}, blob2...)
+		tampered[i] ^= 1
+		if _, err := OpenState(tampered, keys); err == nil {
+			t.Fatalf("expected error on tampered byte %d", i)
+		}
+	}
+
+	cli, err := Client(cConn, &tls.Config{
+		InsecureSkipVerify: true,
+	}, opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, cli)
+}
@@ -0,0 +1,244 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	intref "github.com/igolaizola/resumetls/internal/reflect"
+)
+
+// maxTickets is the number of most recent session tickets kept by a client
+const maxTickets = 4
+
+// sessionCapture records the session offered by a client in the handshake,
+// the session tickets received and the time readings of the handshake, so
+// the handshake can be replayed with the same session and ticket age
+type sessionCapture struct {
+	mu        sync.Mutex
+	recording bool
+	replaying bool
+	times     []int64
+	next      int
+	session   []byte
+	tickets   [][]byte
+	resumed   *tls.SessionState
+}
+
+// wrap makes cfg read the time and the client session cache through the
+// capture
+func (sc *sessionCapture) wrap(cfg *tls.Config) {
+	now := cfg.Time
+	if now == nil {
+		now = time.Now
+	}
+	cfg.Time = func() time.Time {
+		return sc.now(now)
+	}
+	// A replayed handshake offers the recorded session even if the config
+	// has no session cache
+	if cfg.ClientSessionCache != nil || (sc.replaying && len(sc.session) > 0) {
+		cfg.ClientSessionCache = &sessionCache{cache: cfg.ClientSessionCache, capture: sc}
+	}
+	if unwrap := cfg.UnwrapSession; unwrap != nil {
+		cfg.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+			session, err := unwrap(identity, cs)
+			if session != nil {
+				sc.mu.Lock()
+				defer sc.mu.Unlock()
+				if sc.recording || sc.replaying {
+					sc.resumed = session
+				}
+			}
+			return session, err
+		}
+	}
+}
+
+// now returns the next recorded time while replaying and records the time
+// while recording
+func (sc *sessionCapture) now(now func() time.Time) time.Time {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.replaying && sc.next < len(sc.times) {
+		t := time.Unix(0, sc.times[sc.next])
+		sc.next++
+		return t
+	}
+	t := now()
+	if sc.recording {
+		sc.times = append(sc.times, t.UnixNano())
+	}
+	return t
+}
+
+// finish stops recording or replaying once the handshake is completed.
+// Time readings only affect the handshake messages when a session is offered
+// or unwrapped, otherwise they are dropped so a replay with verification uses
+// the current time.
+func (sc *sessionCapture) finish() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.recording && sc.session == nil && sc.resumed == nil {
+		sc.times = nil
+	}
+	sc.recording = false
+	sc.replaying = false
+}
+
+// snapshot returns the offered session, the received tickets and the time
+// readings of the handshake
+func (sc *sessionCapture) snapshot() ([]byte, [][]byte, []int64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.session, slices.Clone(sc.tickets), slices.Clone(sc.times)
+}
+
+// sessionCache is a tls.ClientSessionCache that records the session offered
+// in the handshake and the tickets received
+type sessionCache struct {
+	cache   tls.ClientSessionCache
+	capture *sessionCapture
+}
+
+// Get returns the recorded session while replaying, otherwise the session is
+// obtained from the wrapped cache and recorded
+func (c *sessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	sc := c.capture
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.replaying {
+		if len(sc.session) == 0 {
+			return nil, false
+		}
+		session, err := decodeSession(sc.session)
+		if err != nil {
+			return nil, false
+		}
+		_, sc.resumed, _ = session.ResumptionState()
+		return session, true
+	}
+	if c.cache == nil {
+		return nil, false
+	}
+	session, ok := c.cache.Get(sessionKey)
+	if !ok || session == nil {
+		return session, ok
+	}
+	if sc.recording {
+		// Sessions that can't be encoded aren't offered, otherwise the
+		// handshake couldn't be replayed
+		b, err := encodeSession(session)
+		if err != nil {
+			return nil, false
+		}
+		sc.session = b
+		_, sc.resumed, _ = session.ResumptionState()
+	}
+	return session, ok
+}
+
+// Put stores the session in the wrapped cache and records it as a received
+// ticket, older tickets are dropped. Tickets received while replaying were
+// already recorded.
+func (c *sessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	sc := c.capture
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.replaying {
+		return
+	}
+	if c.cache != nil {
+		c.cache.Put(sessionKey, cs)
+	}
+	if cs == nil {
+		return
+	}
+	if b, err := encodeSession(cs); err == nil {
+		sc.tickets = append(sc.tickets, b)
+		if n := len(sc.tickets) - maxTickets; n > 0 {
+			sc.tickets = slices.Delete(sc.tickets, 0, n)
+		}
+	}
+}
+
+// masterSecret returns the TLS 1.2 master secret of the session resumed by
+// the handshake, which isn't written to the key log
+func (sc *sessionCapture) masterSecret() ([]byte, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.resumed == nil {
+		return nil, errors.New("resumed session not found")
+	}
+	r := reflect.ValueOf(sc.resumed).Elem()
+	return cloneBytes(intref.FieldToInterface(r, "secret").([]byte)), nil
+}
+
+// encodeSession encodes a client session as the length prefixed ticket
+// followed by the session state
+func encodeSession(cs *tls.ClientSessionState) ([]byte, error) {
+	ticket, state, err := cs.ResumptionState()
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, errors.New("empty session")
+	}
+	b, err := state.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(ticket)))
+	out = append(out, ticket...)
+	return append(out, b...), nil
+}
+
+// decodeSession decodes a client session encoded by encodeSession
+func decodeSession(b []byte) (*tls.ClientSessionState, error) {
+	if len(b) < 4 {
+		return nil, errors.New("truncated session")
+	}
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint64(n) > uint64(len(b)) {
+		return nil, errors.New("truncated session ticket")
+	}
+	state, err := tls.ParseSessionState(b[n:])
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewResumptionState(cloneBytes(b[:n]), state)
+}
+
+// Tickets returns the most recent session tickets received by a client conn.
+// They can be stored in a tls.ClientSessionCache to perform standard TLS
+// session resumption on new connections.
+func (s *State) Tickets() ([]*tls.ClientSessionState, error) {
+	var sessions []*tls.ClientSessionState
+	for _, b := range s.tickets {
+		session, err := decodeSession(b)
+		if err != nil {
+			return nil, corruptError(fmt.Errorf("couldn't decode session ticket: %w", err))
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// getResumptionSecret obtains the TLS 1.3 resumption secret
+func getResumptionSecret(conn *tls.Conn) []byte {
+	r := reflect.ValueOf(conn).Elem()
+	return intref.FieldToInterface(r, "resumptionSecret").([]byte)
+}
+
+// setResumptionSecret overrides the TLS 1.3 resumption secret, which is used
+// to derive session tickets received after the handshake
+func setResumptionSecret(conn *tls.Conn, secret []byte) {
+	r := reflect.ValueOf(conn).Elem()
+	intref.SetFieldValue(r, "resumptionSecret", secret)
+}
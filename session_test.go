@@ -0,0 +1,107 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestSessionTickets(t *testing.T) {
+	// Sessions with expired certificates aren't resumed
+	pair := newCertificate(t)
+	cliCfg := func(version uint16, cache tls.ClientSessionCache) *tls.Config {
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "localhost",
+			MinVersion:         version,
+			MaxVersion:         version,
+			ClientSessionCache: cache,
+		}
+	}
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		for _, compact := range []bool{false, true} {
+			name := tls.VersionName(version)
+			if compact {
+				name += "/Compact"
+			}
+			t.Run(name, func(t *testing.T) {
+				// The server config is shared so tickets are encrypted
+				// with the same keys
+				srvCfg := &tls.Config{Certificates: []tls.Certificate{pair}}
+				state := func(c *Conn) *State {
+					t.Helper()
+					if !compact {
+						return c.State()
+					}
+					s, err := c.CompactState()
+					if err != nil {
+						t.Fatal(err)
+					}
+					return s
+				}
+
+				cache := tls.NewLRUClientSessionCache(8)
+				c, conn := handshakedConn(t, true, cliCfg(version, cache), srvCfg)
+				s := state(c)
+				if len(s.tickets) == 0 {
+					t.Fatal("no session tickets captured")
+				}
+
+				// Tickets received after resuming are captured too
+				resumed, err := Client(conn, cliCfg(version, tls.NewLRUClientSessionCache(8)), s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				echo(t, resumed)
+				tickets, err := state(resumed).Tickets()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tickets) == 0 {
+					t.Fatal("no session tickets after resuming")
+				}
+
+				// The last ticket performs a standard TLS resumption
+				cache = tls.NewLRUClientSessionCache(8)
+				cache.Put("localhost", tickets[len(tickets)-1])
+				c, conn = handshakedConn(t, true, cliCfg(version, cache), srvCfg)
+				if !c.ConnectionState().DidResume {
+					t.Fatal("session wasn't resumed using the ticket")
+				}
+
+				// A conn that offered a session can be resumed without
+				// access to the original session cache
+				resumed, err = Client(conn, cliCfg(version, nil), state(c))
+				if err != nil {
+					t.Fatal(err)
+				}
+				echo(t, resumed)
+			})
+		}
+	}
+}
+
+func TestSessionTicketsLimit(t *testing.T) {
+	cliCfg := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "localhost",
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+	c, _ := handshakedConn(t, true, cliCfg, &tls.Config{Certificates: []tls.Certificate{newCertificate(t)}})
+	tickets, err := c.State().Tickets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tickets) == 0 {
+		t.Fatal("no session tickets captured")
+	}
+
+	// Only the most recent tickets are kept
+	cache := &sessionCache{capture: &sessionCapture{}}
+	for i := 0; i < 2*maxTickets; i++ {
+		cache.Put("localhost", tickets[0])
+	}
+	if n := len(cache.capture.tickets); n != maxTickets {
+		t.Fatalf("unexpected tickets %d", n)
+	}
+}
@@ -0,0 +1,556 @@
+package resumetls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/igolaizola/resumetls/internal/suite"
+)
+
+// stateMagic prefixes every binary encoded state
+var stateMagic = [4]byte{'R', 'T', 'L', 'S'}
+
+// stateVersion is the current binary state format version
+const stateVersion = 1
+
+// State field tags, encoded in ascending order
+const (
+	tagConn byte = iota + 1
+	tagRand
+	tagInSeq
+	tagOutSeq
+	tagCipherSuite
+	tagVersion
+	tagInKey
+	tagInIV
+	tagInMAC
+	tagOutKey
+	tagOutIV
+	tagOutMAC
+	tagVerifiedChains
+	tagServerName
+	tagCertFingerprint
+	tagRole
+	tagRawInput
+	tagInput
+	tagHand
+	tagInSecret
+	tagOutSecret
+	tagSession
+	tagTickets
+	tagHandshakeTimes
+	tagResumptionSecret
+	tagKeyLog
+)
+
+// stateHeaderLen is the length of magic plus version
+const stateHeaderLen = len(stateMagic) + 1
+
+// stateFieldHeaderLen is the length of a field tag plus its length prefix
+const stateFieldHeaderLen = 1 + 4
+
+// StateVersionError is returned when decoding a state with an unsupported
+// format version
+type StateVersionError struct {
+	Version int
+}
+
+func (e *StateVersionError) Error() string {
+	return fmt.Sprintf("resumetls: unsupported state version %d", e.Version)
+}
+
+// StateFieldError is returned when decoding a malformed state field
+type StateFieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e *StateFieldError) Error() string {
+	return fmt.Sprintf("resumetls: invalid state field %s: %s", e.Field, e.Reason)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+//
+// The format is the magic "RTLS", a version byte and a sequence of fields in
+// ascending tag order, each one encoded as a tag byte, a big endian uint32
+// length and the field value. Empty optional fields are omitted.
+func (s *State) MarshalBinary() ([]byte, error) {
+	fields := s.binaryFields()
+	n := stateHeaderLen
+	for _, f := range fields {
+		n += stateFieldHeaderLen + len(f.value)
+	}
+	b := make([]byte, 0, n)
+	b = append(b, stateMagic[:]...)
+	b = append(b, stateVersion)
+	for _, f := range fields {
+		b = appendField(b, f.tag, f.value)
+	}
+	return b, nil
+}
+
+// binaryField is a tagged state field
+type binaryField struct {
+	tag   byte
+	value []byte
+}
+
+// binaryFields returns the fields to be encoded in tag order
+func (s *State) binaryFields() []binaryField {
+	var fields []binaryField
+	add := func(tag byte, value []byte, optional bool) {
+		if optional && len(value) == 0 {
+			return
+		}
+		fields = append(fields, binaryField{tag: tag, value: value})
+	}
+	compact := s.compact()
+	add(tagConn, s.conn, compact)
+	add(tagRand, s.rand, compact)
+	add(tagInSeq, s.inSeq[:], false)
+	add(tagOutSeq, s.outSeq[:], false)
+	add(tagCipherSuite, binary.BigEndian.AppendUint16(nil, s.cipherSuite), false)
+	if s.version != 0 {
+		add(tagVersion, binary.BigEndian.AppendUint16(nil, s.version), false)
+	}
+	add(tagInKey, s.inKeys.Key, true)
+	add(tagInIV, s.inKeys.IV, true)
+	add(tagInMAC, s.inKeys.MAC, true)
+	add(tagOutKey, s.outKeys.Key, true)
+	add(tagOutIV, s.outKeys.IV, true)
+	add(tagOutMAC, s.outKeys.MAC, true)
+	add(tagVerifiedChains, encodeChains(s.verifiedChains), true)
+	add(tagServerName, []byte(s.serverName), true)
+	add(tagCertFingerprint, s.certFingerprint, true)
+	if s.role != 0 {
+		add(tagRole, []byte{byte(s.role)}, false)
+	}
+	add(tagRawInput, s.pending.rawInput, true)
+	add(tagInput, s.pending.input, true)
+	add(tagHand, s.pending.hand, true)
+	add(tagInSecret, s.inSecret, true)
+	add(tagOutSecret, s.outSecret, true)
+	add(tagSession, s.session, true)
+	add(tagTickets, encodeList(s.tickets), true)
+	add(tagHandshakeTimes, encodeTimes(s.handshakeTimes), true)
+	add(tagResumptionSecret, s.resumptionSecret, true)
+	add(tagKeyLog, s.keyLog, true)
+	return fields
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (s *State) UnmarshalBinary(data []byte) error {
+	if len(data) < stateHeaderLen {
+		return &StateFieldError{Field: "header", Reason: "truncated"}
+	}
+	if [4]byte(data[:4]) != stateMagic {
+		return &StateFieldError{Field: "header", Reason: "bad magic"}
+	}
+	if v := int(data[4]); v != stateVersion {
+		return &StateVersionError{Version: v}
+	}
+
+	var st State
+	var last byte
+	seen := map[byte]bool{}
+	data = data[stateHeaderLen:]
+	for len(data) > 0 {
+		if len(data) < stateFieldHeaderLen {
+			return &StateFieldError{Field: "header", Reason: "truncated field header"}
+		}
+		tag := data[0]
+		n := binary.BigEndian.Uint32(data[1:5])
+		data = data[stateFieldHeaderLen:]
+		if uint64(n) > uint64(len(data)) {
+			return &StateFieldError{Field: tagName(tag), Reason: "truncated value"}
+		}
+		value := data[:n]
+		data = data[n:]
+
+		if tag <= last {
+			return &StateFieldError{Field: tagName(tag), Reason: "duplicated or out of order"}
+		}
+		last = tag
+		seen[tag] = true
+
+		switch tag {
+		case tagConn:
+			st.conn = cloneBytes(value)
+		case tagRand:
+			st.rand = cloneBytes(value)
+		case tagInSeq:
+			if len(value) != len(st.inSeq) {
+				return fieldLenError(tag, len(value), len(st.inSeq))
+			}
+			copy(st.inSeq[:], value)
+		case tagOutSeq:
+			if len(value) != len(st.outSeq) {
+				return fieldLenError(tag, len(value), len(st.outSeq))
+			}
+			copy(st.outSeq[:], value)
+		case tagCipherSuite:
+			if len(value) != 2 {
+				return fieldLenError(tag, len(value), 2)
+			}
+			st.cipherSuite = binary.BigEndian.Uint16(value)
+		case tagVersion:
+			if len(value) != 2 {
+				return fieldLenError(tag, len(value), 2)
+			}
+			st.version = binary.BigEndian.Uint16(value)
+		case tagInKey:
+			st.inKeys.Key = cloneBytes(value)
+		case tagInIV:
+			st.inKeys.IV = cloneBytes(value)
+		case tagInMAC:
+			st.inKeys.MAC = cloneBytes(value)
+		case tagOutKey:
+			st.outKeys.Key = cloneBytes(value)
+		case tagOutIV:
+			st.outKeys.IV = cloneBytes(value)
+		case tagOutMAC:
+			st.outKeys.MAC = cloneBytes(value)
+		case tagVerifiedChains:
+			chains, err := decodeChains(value)
+			if err != nil {
+				return &StateFieldError{Field: tagName(tag), Reason: err.Error()}
+			}
+			st.verifiedChains = chains
+		case tagServerName:
+			st.serverName = string(value)
+		case tagCertFingerprint:
+			st.certFingerprint = cloneBytes(value)
+		case tagRole:
+			if len(value) != 1 {
+				return fieldLenError(tag, len(value), 1)
+			}
+			st.role = Role(value[0])
+		case tagRawInput:
+			st.pending.rawInput = cloneBytes(value)
+		case tagInput:
+			st.pending.input = cloneBytes(value)
+		case tagHand:
+			st.pending.hand = cloneBytes(value)
+		case tagInSecret:
+			st.inSecret = cloneBytes(value)
+		case tagOutSecret:
+			st.outSecret = cloneBytes(value)
+		case tagSession:
+			st.session = cloneBytes(value)
+		case tagTickets:
+			tickets, err := decodeList(value)
+			if err != nil {
+				return &StateFieldError{Field: tagName(tag), Reason: err.Error()}
+			}
+			st.tickets = tickets
+		case tagHandshakeTimes:
+			if len(value)%8 != 0 {
+				return &StateFieldError{Field: tagName(tag), Reason: fmt.Sprintf("length %d not a multiple of 8", len(value))}
+			}
+			st.handshakeTimes = decodeTimes(value)
+		case tagResumptionSecret:
+			st.resumptionSecret = cloneBytes(value)
+		case tagKeyLog:
+			st.keyLog = cloneBytes(value)
+		default:
+			return &StateFieldError{Field: tagName(tag), Reason: "unknown field"}
+		}
+	}
+
+	if err := checkRequired(seen[tagInKey], func(tag byte) bool { return seen[tag] }); err != nil {
+		return err
+	}
+	if err := st.validate(); err != nil {
+		return err
+	}
+
+	*s = st
+	return nil
+}
+
+// checkRequired checks that the fields required by full or compact states
+// are present in an encoded state, which is shared by every decoder
+func checkRequired(compact bool, present func(tag byte) bool) error {
+	required := []byte{tagInSeq, tagOutSeq, tagCipherSuite}
+	if compact {
+		required = append(required, tagVersion)
+	} else {
+		required = append(required, tagConn, tagRand)
+	}
+	for _, tag := range required {
+		if !present(tag) {
+			return &StateFieldError{Field: tagName(tag), Reason: "missing"}
+		}
+	}
+	return nil
+}
+
+// validate checks the consistency of a decoded state
+func (s *State) validate() error {
+	if s.cipherSuite == 0 {
+		return &StateFieldError{Field: tagName(tagCipherSuite), Reason: "zero value"}
+	}
+	for _, chain := range s.verifiedChains {
+		if len(chain) == 0 {
+			return &StateFieldError{Field: tagName(tagVerifiedChains), Reason: "empty chain"}
+		}
+		for _, cert := range chain {
+			if len(cert) == 0 {
+				return &StateFieldError{Field: tagName(tagVerifiedChains), Reason: "empty certificate"}
+			}
+		}
+	}
+	if s.role != 0 && s.role != RoleClient && s.role != RoleServer {
+		return &StateFieldError{Field: tagName(tagRole), Reason: fmt.Sprintf("unknown role %d", s.role)}
+	}
+	if n := len(s.certFingerprint); n != 0 && n != sha256.Size {
+		return fieldLenError(tagCertFingerprint, n, sha256.Size)
+	}
+	if err := s.validateSecrets(); err != nil {
+		return err
+	}
+	for _, ticket := range s.tickets {
+		if len(ticket) == 0 {
+			return &StateFieldError{Field: tagName(tagTickets), Reason: "empty ticket"}
+		}
+	}
+	if len(s.resumptionSecret) > 0 && s.version != tls.VersionTLS13 {
+		return &StateFieldError{Field: tagName(tagResumptionSecret), Reason: "only allowed in TLS 1.3 states"}
+	}
+	if err := checkKeyLog(s.keyLog); err != nil {
+		return &StateFieldError{Field: tagName(tagKeyLog), Reason: err.Error()}
+	}
+	if !s.compact() {
+		if len(s.conn) == 0 {
+			return &StateFieldError{Field: tagName(tagConn), Reason: "empty"}
+		}
+		if len(s.outKeys.Key) > 0 {
+			return &StateFieldError{Field: tagName(tagInKey), Reason: "missing"}
+		}
+		return nil
+	}
+
+	if len(s.conn) > 0 || len(s.rand) > 0 {
+		return &StateFieldError{Field: tagName(tagConn), Reason: "not allowed in compact state"}
+	}
+	cs, err := suite.Lookup(s.version, s.cipherSuite)
+	if err != nil {
+		return &StateFieldError{Field: tagName(tagCipherSuite), Reason: err.Error()}
+	}
+	for _, f := range []struct {
+		tag   byte
+		value []byte
+		want  int
+	}{
+		{tagInKey, s.inKeys.Key, cs.KeyLen},
+		{tagInIV, s.inKeys.IV, cs.IVLen},
+		{tagInMAC, s.inKeys.MAC, cs.MACLen()},
+		{tagOutKey, s.outKeys.Key, cs.KeyLen},
+		{tagOutIV, s.outKeys.IV, cs.IVLen},
+		{tagOutMAC, s.outKeys.MAC, cs.MACLen()},
+	} {
+		if len(f.value) != f.want {
+			return fieldLenError(f.tag, len(f.value), f.want)
+		}
+	}
+	return nil
+}
+
+// validateSecrets checks that traffic secrets are only present in TLS 1.3
+// states and match the hash length of the cipher suite
+func (s *State) validateSecrets() error {
+	if len(s.inSecret) == 0 && len(s.outSecret) == 0 {
+		return nil
+	}
+	if s.version != tls.VersionTLS13 {
+		return &StateFieldError{Field: tagName(tagInSecret), Reason: "only allowed in TLS 1.3 states"}
+	}
+	cs, err := suite.Lookup(s.version, s.cipherSuite)
+	if err != nil {
+		return &StateFieldError{Field: tagName(tagCipherSuite), Reason: err.Error()}
+	}
+	if len(s.inSecret) != cs.Hash.Size() {
+		return fieldLenError(tagInSecret, len(s.inSecret), cs.Hash.Size())
+	}
+	if len(s.outSecret) != cs.Hash.Size() {
+		return fieldLenError(tagOutSecret, len(s.outSecret), cs.Hash.Size())
+	}
+	return nil
+}
+
+// appendField appends a tag, length and value to b
+func appendField(b []byte, tag byte, value []byte) []byte {
+	b = append(b, tag)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(value)))
+	return append(b, value...)
+}
+
+// tagName returns a human readable name of a field tag
+func tagName(tag byte) string {
+	switch tag {
+	case tagConn:
+		return "conn"
+	case tagRand:
+		return "rand"
+	case tagInSeq:
+		return "inSeq"
+	case tagOutSeq:
+		return "outSeq"
+	case tagCipherSuite:
+		return "cipherSuite"
+	case tagVersion:
+		return "version"
+	case tagInKey:
+		return "inKey"
+	case tagInIV:
+		return "inIV"
+	case tagInMAC:
+		return "inMAC"
+	case tagOutKey:
+		return "outKey"
+	case tagOutIV:
+		return "outIV"
+	case tagOutMAC:
+		return "outMAC"
+	case tagVerifiedChains:
+		return "verifiedChains"
+	case tagServerName:
+		return "serverName"
+	case tagCertFingerprint:
+		return "certFingerprint"
+	case tagRole:
+		return "role"
+	case tagRawInput:
+		return "rawInput"
+	case tagInput:
+		return "input"
+	case tagHand:
+		return "hand"
+	case tagInSecret:
+		return "inSecret"
+	case tagOutSecret:
+		return "outSecret"
+	case tagSession:
+		return "session"
+	case tagTickets:
+		return "tickets"
+	case tagHandshakeTimes:
+		return "handshakeTimes"
+	case tagResumptionSecret:
+		return "resumptionSecret"
+	case tagKeyLog:
+		return "keyLog"
+	default:
+		return fmt.Sprintf("tag(%d)", tag)
+	}
+}
+
+// fieldLenError returns an error for a field with an unexpected length
+func fieldLenError(tag byte, got, want int) error {
+	return &StateFieldError{
+		Field:  tagName(tag),
+		Reason: fmt.Sprintf("length %d, want %d", got, want),
+	}
+}
+
+// cloneBytes returns a copy of b that doesn't alias the decoded data
+func cloneBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
+
+// encodeChains encodes certificate chains as a sequence of length prefixed
+// chains, each one a sequence of length prefixed certificates
+func encodeChains(chains [][][]byte) []byte {
+	var b []byte
+	for _, chain := range chains {
+		var c []byte
+		for _, cert := range chain {
+			c = binary.BigEndian.AppendUint32(c, uint32(len(cert)))
+			c = append(c, cert...)
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(len(c)))
+		b = append(b, c...)
+	}
+	return b
+}
+
+// decodeChains decodes certificate chains encoded by encodeChains
+func decodeChains(b []byte) ([][][]byte, error) {
+	next := func(b []byte) ([]byte, []byte, error) {
+		if len(b) < 4 {
+			return nil, nil, errors.New("truncated length")
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) || n == 0 {
+			return nil, nil, errors.New("invalid length")
+		}
+		return b[4 : 4+n], b[4+n:], nil
+	}
+	var chains [][][]byte
+	for len(b) > 0 {
+		c, rest, err := next(b)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		var chain [][]byte
+		for len(c) > 0 {
+			cert, rest, err := next(c)
+			if err != nil {
+				return nil, err
+			}
+			c = rest
+			chain = append(chain, cloneBytes(cert))
+		}
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
+// encodeList encodes a list of length prefixed values
+func encodeList(list [][]byte) []byte {
+	var b []byte
+	for _, v := range list {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+// decodeList decodes a list encoded by encodeList
+func decodeList(b []byte) ([][]byte, error) {
+	var list [][]byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("truncated length")
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) || n == 0 {
+			return nil, errors.New("invalid length")
+		}
+		list = append(list, cloneBytes(b[4:4+n]))
+		b = b[4+n:]
+	}
+	return list, nil
+}
+
+// encodeTimes encodes unix nanosecond times as big endian uint64 values
+func encodeTimes(times []int64) []byte {
+	var b []byte
+	for _, t := range times {
+		b = binary.BigEndian.AppendUint64(b, uint64(t))
+	}
+	return b
+}
+
+// decodeTimes decodes times encoded by encodeTimes
+func decodeTimes(b []byte) []int64 {
+	var times []int64
+	for ; len(b) >= 8; b = b[8:] {
+		times = append(times, int64(binary.BigEndian.Uint64(b)))
+	}
+	return times
+}
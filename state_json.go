@@ -0,0 +1,235 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/igolaizola/resumetls/internal/suite"
+)
+
+// stateJSON is the json representation of a state
+type stateJSON struct {
+	Version     int       `json:"version"`
+	Conn        []byte    `json:"conn,omitempty"`
+	Rand        []byte    `json:"rand,omitempty"`
+	InSeq       string    `json:"inSeq"`
+	OutSeq      string    `json:"outSeq"`
+	CipherSuite string    `json:"cipherSuite"`
+	TLSVersion  string    `json:"tlsVersion,omitempty"`
+	In          *keysJSON `json:"in,omitempty"`
+	Out         *keysJSON `json:"out,omitempty"`
+
+	VerifiedChains  [][][]byte `json:"verifiedChains,omitempty"`
+	ServerName      string     `json:"serverName,omitempty"`
+	CertFingerprint []byte     `json:"certFingerprint,omitempty"`
+	Role            string     `json:"role,omitempty"`
+	RawInput        []byte     `json:"rawInput,omitempty"`
+	Input           []byte     `json:"input,omitempty"`
+	Hand            []byte     `json:"hand,omitempty"`
+	InSecret        []byte     `json:"inSecret,omitempty"`
+	OutSecret       []byte     `json:"outSecret,omitempty"`
+
+	Session          []byte   `json:"session,omitempty"`
+	Tickets          [][]byte `json:"tickets,omitempty"`
+	HandshakeTimes   []int64  `json:"handshakeTimes,omitempty"`
+	ResumptionSecret []byte   `json:"resumptionSecret,omitempty"`
+	KeyLog           string   `json:"keyLog,omitempty"`
+}
+
+// keysJSON is the json representation of record keys
+type keysJSON struct {
+	Key []byte `json:"key"`
+	IV  []byte `json:"iv"`
+	MAC []byte `json:"mac,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// Byte fields are base64 encoded, sequence numbers are hex encoded, the
+// cipher suite is encoded using its name and the key log is kept as text.
+func (s *State) MarshalJSON() ([]byte, error) {
+	js := &stateJSON{
+		Version:         stateVersion,
+		Conn:            s.conn,
+		Rand:            s.rand,
+		InSeq:           hex.EncodeToString(s.inSeq[:]),
+		OutSeq:          hex.EncodeToString(s.outSeq[:]),
+		CipherSuite:     tls.CipherSuiteName(s.cipherSuite),
+		VerifiedChains:  s.verifiedChains,
+		ServerName:      s.serverName,
+		CertFingerprint: s.certFingerprint,
+		RawInput:        s.pending.rawInput,
+		Input:           s.pending.input,
+		Hand:            s.pending.hand,
+		InSecret:        s.inSecret,
+		OutSecret:       s.outSecret,
+
+		Session:          s.session,
+		Tickets:          s.tickets,
+		HandshakeTimes:   s.handshakeTimes,
+		ResumptionSecret: s.resumptionSecret,
+		KeyLog:           string(s.keyLog),
+	}
+	if s.version != 0 {
+		js.TLSVersion = tls.VersionName(s.version)
+	}
+	if s.role != 0 {
+		js.Role = s.role.String()
+	}
+	if s.compact() {
+		js.In = &keysJSON{Key: s.inKeys.Key, IV: s.inKeys.IV, MAC: s.inKeys.MAC}
+		js.Out = &keysJSON{Key: s.outKeys.Key, IV: s.outKeys.IV, MAC: s.outKeys.MAC}
+	}
+	return json.Marshal(js)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *State) UnmarshalJSON(data []byte) error {
+	var js stateJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&js); err != nil {
+		return &StateFieldError{Field: "json", Reason: err.Error()}
+	}
+	if js.Version != stateVersion {
+		return &StateVersionError{Version: js.Version}
+	}
+
+	present := map[byte]bool{
+		tagConn:        js.Conn != nil,
+		tagRand:        js.Rand != nil,
+		tagInSeq:       js.InSeq != "",
+		tagOutSeq:      js.OutSeq != "",
+		tagCipherSuite: js.CipherSuite != "",
+		tagVersion:     js.TLSVersion != "",
+	}
+	if err := checkRequired(js.In != nil, func(tag byte) bool { return present[tag] }); err != nil {
+		return err
+	}
+
+	var st State
+	st.conn = js.Conn
+	st.rand = js.Rand
+	st.verifiedChains = js.VerifiedChains
+	st.serverName = js.ServerName
+	st.certFingerprint = js.CertFingerprint
+	st.pending = buffers{rawInput: js.RawInput, input: js.Input, hand: js.Hand}
+	st.inSecret = js.InSecret
+	st.outSecret = js.OutSecret
+	st.session = js.Session
+	st.tickets = js.Tickets
+	st.handshakeTimes = js.HandshakeTimes
+	st.resumptionSecret = js.ResumptionSecret
+	if js.KeyLog != "" {
+		st.keyLog = []byte(js.KeyLog)
+	}
+	if err := parseSeq(tagInSeq, js.InSeq, &st.inSeq); err != nil {
+		return err
+	}
+	if err := parseSeq(tagOutSeq, js.OutSeq, &st.outSeq); err != nil {
+		return err
+	}
+	id, err := parseCipherSuite(js.CipherSuite)
+	if err != nil {
+		return err
+	}
+	st.cipherSuite = id
+	if js.TLSVersion != "" {
+		if st.version, err = parseVersion(js.TLSVersion); err != nil {
+			return err
+		}
+	}
+	if js.Role != "" {
+		role, ok := parseRole(js.Role)
+		if !ok {
+			return &StateFieldError{Field: tagName(tagRole), Reason: fmt.Sprintf("unknown role %q", js.Role)}
+		}
+		st.role = role
+	}
+	if js.In != nil {
+		st.inKeys = suite.Keys{Key: js.In.Key, IV: js.In.IV, MAC: js.In.MAC}
+	}
+	if js.Out != nil {
+		st.outKeys = suite.Keys{Key: js.Out.Key, IV: js.Out.IV, MAC: js.Out.MAC}
+	}
+	if err := st.validate(); err != nil {
+		return err
+	}
+
+	*s = st
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+//
+// The text form is the indented JSON form, so states can be read and diffed
+// in config files and test fixtures.
+func (s *State) MarshalText() ([]byte, error) {
+	b, err := s.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var text bytes.Buffer
+	if err := json.Indent(&text, b, "", "  "); err != nil {
+		return nil, err
+	}
+	return text.Bytes(), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (s *State) UnmarshalText(text []byte) error {
+	return s.UnmarshalJSON(text)
+}
+
+// parseSeq decodes a hex sequence number
+func parseSeq(tag byte, text string, seq *[8]byte) error {
+	b, err := hex.DecodeString(text)
+	if err != nil {
+		return &StateFieldError{Field: tagName(tag), Reason: err.Error()}
+	}
+	if len(b) != len(seq) {
+		return fieldLenError(tag, len(b), len(seq))
+	}
+	copy(seq[:], b)
+	return nil
+}
+
+// parseCipherSuite decodes a cipher suite name as returned by
+// tls.CipherSuiteName
+func parseCipherSuite(name string) (uint16, error) {
+	for _, list := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, cs := range list {
+			if cs.Name == name {
+				return cs.ID, nil
+			}
+		}
+	}
+	// Unknown suites are named using their hex value
+	if hexID, ok := strings.CutPrefix(name, "0x"); ok && len(hexID) == 4 {
+		if id, err := strconv.ParseUint(hexID, 16, 16); err == nil && id != 0 {
+			return uint16(id), nil
+		}
+	}
+	return 0, &StateFieldError{
+		Field:  tagName(tagCipherSuite),
+		Reason: fmt.Sprintf("unknown cipher suite %q", name),
+	}
+}
+
+// parseVersion decodes a tls version name as returned by tls.VersionName
+func parseVersion(name string) (uint16, error) {
+	for _, v := range []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13} {
+		if tls.VersionName(v) == name {
+			return v, nil
+		}
+	}
+	return 0, &StateFieldError{
+		Field:  tagName(tagVersion),
+		Reason: fmt.Sprintf("unknown tls version %q", name),
+	}
+}
@@ -0,0 +1,186 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStateBinary(t *testing.T) {
+	for _, tt := range ciphers {
+		t.Run(tt.name, func(t *testing.T) {
+			state, cConn := pausedClient(t, tt.ciphers)
+			defer cConn.Close()
+
+			data, err := state.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded State
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			again, err := decoded.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, again) {
+				t.Fatal("state binary encoding isn't stable")
+			}
+
+			cli, err := Client(cConn, &tls.Config{
+				InsecureSkipVerify: true,
+			}, &decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			echo(t, cli)
+		})
+	}
+}
+
+func TestStateBinaryInvalid(t *testing.T) {
+	state := &State{
+		conn:        []byte{22, 3, 3, 0, 0},
+		rand:        []byte{1, 2, 3},
+		inSeq:       [8]byte{0, 0, 0, 0, 0, 0, 0, 1},
+		outSeq:      [8]byte{0, 0, 0, 0, 0, 0, 0, 2},
+		cipherSuite: tls.TLS_AES_128_GCM_SHA256,
+	}
+	valid, err := state.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+	var versionErr *StateVersionError
+	var fieldErr *StateFieldError
+	tests := []struct {
+		name string
+		data []byte
+		want any
+	}{
+		{"empty", nil, &fieldErr},
+		{"magic", modify(func(b []byte) []byte { b[0] = 'X'; return b }), &fieldErr},
+		{"version", modify(func(b []byte) []byte { b[4] = 99; return b }), &versionErr},
+		{"truncated", valid[:len(valid)-1], &fieldErr},
+		{"trailing", append(append([]byte{}, valid...), 0), &fieldErr},
+		{"missing", valid[:len(valid)-(stateFieldHeaderLen+2)], &fieldErr},
+		{"length", modify(func(b []byte) []byte {
+			// Shorten the inSeq field, which follows conn and rand
+			i := stateHeaderLen + 2*stateFieldHeaderLen + 5 + 3
+			b[i+4] = 7
+			return b
+		}), &fieldErr},
+		{"order", modify(func(b []byte) []byte {
+			b[stateHeaderLen] = tagRand
+			return b
+		}), &fieldErr},
+		{"role", appendField(append([]byte{}, valid...), tagRole, []byte{9}), &fieldErr},
+		{"tickets", appendField(append([]byte{}, valid...), tagTickets, []byte{0, 0, 0, 0}), &fieldErr},
+		{"key log", appendField(append([]byte{}, valid...), tagKeyLog, []byte("CLIENT_RANDOM zz 00\n")), &fieldErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s State
+			err := s.UnmarshalBinary(tt.data)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !errors.As(err, tt.want) {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			if !errors.Is(err, ErrStateCorrupt) {
+				t.Fatalf("expected corrupt state error: %v", err)
+			}
+		})
+	}
+}
+
+func TestStateJSON(t *testing.T) {
+	state, cConn := pausedClient(t, nil)
+	defer cConn.Close()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if got := fields["cipherSuite"]; got != tls.CipherSuiteName(state.cipherSuite) {
+		t.Errorf("unexpected cipher suite name %v", got)
+	}
+	if got := fields["outSeq"]; got != "0000000000000001" {
+		t.Errorf("unexpected outSeq %v", got)
+	}
+
+	var decoded State
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := decoded.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(text, []byte(`"cipherSuite": "`+tls.CipherSuiteName(state.cipherSuite)+`"`)) {
+		t.Errorf("text form isn't readable: %s", text)
+	}
+	var fromText State
+	if err := fromText.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := Client(cConn, &tls.Config{
+		InsecureSkipVerify: true,
+	}, &fromText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, cli)
+}
+
+func TestStateJSONInvalid(t *testing.T) {
+	valid := `{"version":1,"conn":"FgMD","rand":"AQID","inSeq":"0000000000000001","outSeq":"0000000000000002","cipherSuite":"TLS_AES_128_GCM_SHA256"}`
+	var s State
+	if err := json.Unmarshal([]byte(valid), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	var versionErr *StateVersionError
+	var fieldErr *StateFieldError
+	tests := []struct {
+		name string
+		data string
+		want any
+	}{
+		{"version", strings.Replace(valid, `"version":1`, `"version":2`, 1), &versionErr},
+		{"unknown field", strings.Replace(valid, `"version":1`, `"version":1,"foo":1`, 1), &fieldErr},
+		{"empty conn", strings.Replace(valid, `"FgMD"`, `""`, 1), &fieldErr},
+		{"missing rand", strings.Replace(valid, `"rand":"AQID",`, ``, 1), &fieldErr},
+		{"missing seq", strings.Replace(valid, `"inSeq":"0000000000000001",`, ``, 1), &fieldErr},
+		{"short seq", strings.Replace(valid, `"0000000000000001"`, `"01"`, 1), &fieldErr},
+		{"hex seq", strings.Replace(valid, `"0000000000000001"`, `"000000000000000z"`, 1), &fieldErr},
+		{"cipher suite", strings.Replace(valid, `TLS_AES_128_GCM_SHA256`, `TLS_FOO`, 1), &fieldErr},
+		{"key log", strings.Replace(valid, `"version":1`, `"version":1,"keyLog":"CLIENT_RANDOM"`, 1), &fieldErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s State
+			err := json.Unmarshal([]byte(tt.data), &s)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !errors.As(err, tt.want) {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,509 @@
+package resumetls
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStateNotFound is returned by state stores when a state id is unknown or
+// its state expired
+var ErrStateNotFound = errors.New("resumetls: state not found")
+
+// StateStore persists states by id so connections can be checkpointed and
+// resumed later
+type StateStore interface {
+	// Save stores the state, replacing the previous state with the same id
+	Save(ctx context.Context, id string, state *State) error
+	// Load returns the state stored with the id, or ErrStateNotFound
+	Load(ctx context.Context, id string) (*State, error)
+	// Delete removes the state stored with the id, deleting an unknown id
+	// isn't an error
+	Delete(ctx context.Context, id string) error
+	// List returns the ids of the stored states in ascending order
+	List(ctx context.Context) ([]string, error)
+}
+
+// StoreOption configures a state store
+type StoreOption func(*storeOptions)
+
+// storeOptions contains the configuration set by StoreOption values
+type storeOptions struct {
+	ttl  time.Duration
+	keys KeyProvider
+	now  func() time.Time
+}
+
+// newStoreOptions applies the given options
+func newStoreOptions(opts []StoreOption) *storeOptions {
+	o := &storeOptions{now: time.Now}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithTTL makes states expire once they were saved longer than d ago.
+// Expired states aren't loaded nor listed and are removed when found.
+// By default states never expire.
+func WithTTL(d time.Duration) StoreOption {
+	return func(o *storeOptions) {
+		o.ttl = d
+	}
+}
+
+// WithSealing makes the store seal states with SealState before storing them
+// and open them with OpenState when loading them, so states are encrypted at
+// rest. By default states are stored binary encoded.
+func WithSealing(keys KeyProvider) StoreOption {
+	return func(o *storeOptions) {
+		o.keys = keys
+	}
+}
+
+// encode encodes a state to be stored, sealing it if configured
+func (o *storeOptions) encode(state *State) ([]byte, error) {
+	if o.keys != nil {
+		return SealState(state, o.keys)
+	}
+	return state.MarshalBinary()
+}
+
+// decode decodes a stored state, opening it if configured
+func (o *storeOptions) decode(data []byte) (*State, error) {
+	if o.keys != nil {
+		return OpenState(data, o.keys)
+	}
+	state := &State{}
+	if err := state.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// expired returns whether a state saved at the given time expired
+func (o *storeOptions) expired(saved time.Time) bool {
+	return o.ttl > 0 && o.now().Sub(saved) >= o.ttl
+}
+
+// MemoryStore is a concurrency safe StateStore that keeps states in memory.
+// States are stored encoded, so they aren't affected by later changes to the
+// saved or loaded values.
+type MemoryStore struct {
+	opts *storeOptions
+
+	mu      sync.Mutex
+	entries map[string]storeEntry
+}
+
+// storeEntry is an encoded state and the time it was saved
+type storeEntry struct {
+	Saved time.Time `json:"saved"`
+	State []byte    `json:"state"`
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore(opts ...StoreOption) *MemoryStore {
+	return &MemoryStore{
+		opts:    newStoreOptions(opts),
+		entries: map[string]storeEntry{},
+	}
+}
+
+// Save stores the state
+func (s *MemoryStore) Save(ctx context.Context, id string, state *State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := s.opts.encode(state)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[id] = storeEntry{Saved: s.opts.now(), State: data}
+	return nil
+}
+
+// Load returns the state stored with the id
+func (s *MemoryStore) Load(ctx context.Context, id string) (*State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	e, ok := s.entries[id]
+	if ok && s.opts.expired(e.Saved) {
+		delete(s.entries, id)
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrStateNotFound
+	}
+	return s.opts.decode(e.State)
+}
+
+// Delete removes the state stored with the id
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+// List returns the ids of the stored states
+func (s *MemoryStore) List(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.entries))
+	for id, e := range s.entries {
+		if s.opts.expired(e.Saved) {
+			delete(s.entries, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// FileStore is a StateStore that keeps every state in a single file, which
+// is replaced atomically with a rename on every change, so a crash leaves
+// either the previous or the new contents.
+// It suits a small number of states, use DirStore for many of them.
+type FileStore struct {
+	path string
+	opts *storeOptions
+
+	mu sync.Mutex
+}
+
+// NewFileStore returns a store backed by the file at path, which is created
+// on the first save
+func NewFileStore(path string, opts ...StoreOption) *FileStore {
+	return &FileStore{path: path, opts: newStoreOptions(opts)}
+}
+
+// Save stores the state
+func (s *FileStore) Save(ctx context.Context, id string, state *State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := s.opts.encode(state)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.read()
+	if err != nil {
+		return err
+	}
+	entries[id] = storeEntry{Saved: s.opts.now(), State: data}
+	return s.write(entries)
+}
+
+// Load returns the state stored with the id
+func (s *FileStore) Load(ctx context.Context, id string) (*State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	e, ok := entries[id]
+	if !ok {
+		return nil, ErrStateNotFound
+	}
+	if s.opts.expired(e.Saved) {
+		delete(entries, id)
+		if err := s.write(entries); err != nil {
+			return nil, err
+		}
+		return nil, ErrStateNotFound
+	}
+	return s.opts.decode(e.State)
+}
+
+// Delete removes the state stored with the id
+func (s *FileStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[id]; !ok {
+		return nil
+	}
+	delete(entries, id)
+	return s.write(entries)
+}
+
+// List returns the ids of the stored states
+func (s *FileStore) List(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	var expired bool
+	for id, e := range entries {
+		if s.opts.expired(e.Saved) {
+			delete(entries, id)
+			expired = true
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if expired {
+		if err := s.write(entries); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// read reads the entries of the file, a missing file has no entries
+func (s *FileStore) read() (map[string]storeEntry, error) {
+	entries := map[string]storeEntry{}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resumetls: couldn't read state store: %w", err)
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("resumetls: couldn't decode state store %s: %w", s.path, err)
+	}
+	return entries, nil
+}
+
+// write replaces the file with the given entries
+func (s *FileStore) write(entries map[string]storeEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// DirStore is a StateStore that keeps every state in its own file, sharded
+// in subdirectories by a hash of the id so directories stay small with many
+// states. Files are replaced atomically with a rename.
+// Several processes can share a directory, the last save of an id wins.
+type DirStore struct {
+	dir  string
+	opts *storeOptions
+}
+
+// NewDirStore returns a store backed by the directory dir, which is created
+// if it doesn't exist
+func NewDirStore(dir string, opts ...StoreOption) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("resumetls: couldn't create state store: %w", err)
+	}
+	return &DirStore{dir: dir, opts: newStoreOptions(opts)}, nil
+}
+
+// stateFileSuffix is the extension of the state files of a DirStore
+const stateFileSuffix = ".state"
+
+// path returns the file of an id, file names are the hex encoded SHA-256 of
+// the id so ids of any length fit in a file name
+func (s *DirStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.dir, name[:2], name+stateFileSuffix)
+}
+
+// Save stores the state
+func (s *DirStore) Save(ctx context.Context, id string, state *State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := s.opts.encode(state)
+	if err != nil {
+		return err
+	}
+	path := s.path(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("resumetls: couldn't create state store shard: %w", err)
+	}
+	return writeFileAtomic(path, appendStateFile(nil, id, data))
+}
+
+// Load returns the state stored with the id
+func (s *DirStore) Load(ctx context.Context, id string) (*State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path := s.path(id)
+	stored, data, err := s.read(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrStateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored != id {
+		return nil, corruptError(fmt.Errorf("state file %s stores id %q", path, stored))
+	}
+	return s.opts.decode(data)
+}
+
+// Delete removes the state stored with the id
+func (s *DirStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("resumetls: couldn't delete state: %w", err)
+	}
+	return nil
+}
+
+// List returns the ids of the stored states, which are read from the files
+func (s *DirStore) List(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	shards, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("resumetls: couldn't list states: %w", err)
+	}
+	var ids []string
+	for _, shard := range shards {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !shard.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(s.dir, shard.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("resumetls: couldn't list states: %w", err)
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), stateFileSuffix) || file.IsDir() {
+				continue
+			}
+			id, _, err := s.read(filepath.Join(s.dir, shard.Name(), file.Name()))
+			if errors.Is(err, ErrStateNotFound) || errors.Is(err, fs.ErrNotExist) {
+				// Expired, or deleted since the directory was read
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// read returns the id and the encoded state stored in a state file, expired
+// files are removed and ErrStateNotFound is returned
+func (s *DirStore) read(path string) (string, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("resumetls: couldn't load state: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, fmt.Errorf("resumetls: couldn't load state: %w", err)
+	}
+	if s.opts.expired(info.ModTime()) {
+		_ = os.Remove(path)
+		return "", nil, ErrStateNotFound
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return "", nil, fmt.Errorf("resumetls: couldn't load state: %w", err)
+	}
+	return parseStateFile(b)
+}
+
+// appendStateFile appends the contents of a state file to b: the length of
+// the id as a uvarint, the id and the encoded state
+func appendStateFile(b []byte, id string, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(id)))
+	b = append(b, id...)
+	return append(b, data...)
+}
+
+// parseStateFile parses the contents of a state file
+func parseStateFile(b []byte) (string, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || uint64(len(b)-size) < n {
+		return "", nil, corruptError(errors.New("truncated state file"))
+	}
+	b = b[size:]
+	return string(b[:n]), b[n:], nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it to path, so readers see either the previous or the new file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("resumetls: couldn't save state: %w", err)
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("resumetls: couldn't save state: %w", err)
+	}
+	// The rename is made durable by syncing the directory, which isn't
+	// supported on every platform
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+	return nil
+}
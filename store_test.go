@@ -0,0 +1,144 @@
+package resumetls
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	state, cConn := pausedClient(t, nil)
+	defer cConn.Close()
+	want, err := state.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	longID := strings.Repeat("x", 1000)
+	for _, tc := range []struct {
+		name  string
+		store func(dir string, opts ...StoreOption) StateStore
+	}{
+		{"memory", func(dir string, opts ...StoreOption) StateStore {
+			return NewMemoryStore(opts...)
+		}},
+		{"file", func(dir string, opts ...StoreOption) StateStore {
+			return NewFileStore(filepath.Join(dir, "states.json"), opts...)
+		}},
+		{"dir", func(dir string, opts ...StoreOption) StateStore {
+			s, err := NewDirStore(filepath.Join(dir, "states"), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}},
+	} {
+		for _, sealed := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s sealed=%v", tc.name, sealed), func(t *testing.T) {
+				ctx := context.Background()
+				now := time.Now()
+				opts := []StoreOption{WithTTL(time.Hour), func(o *storeOptions) {
+					o.now = func() time.Time { return now }
+				}}
+				if sealed {
+					opts = append(opts, WithSealing(keys))
+				}
+				dir := t.TempDir()
+				store := tc.store(dir, opts...)
+
+				if _, err := store.Load(ctx, "a"); !errors.Is(err, ErrStateNotFound) {
+					t.Fatalf("expected not found error, got %v", err)
+				}
+				for _, id := range []string{"b", "a/../x", longID, "a"} {
+					if err := store.Save(ctx, id, state); err != nil {
+						t.Fatal(err)
+					}
+				}
+				ids, err := store.List(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(ids, []string{"a", "a/../x", "b", longID}) {
+					t.Fatalf("unexpected ids %q", ids)
+				}
+				loaded, err := store.Load(ctx, "a/../x")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := loaded.MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatal("loaded state differs")
+				}
+				if _, err := store.Load(ctx, longID); err != nil {
+					t.Fatal(err)
+				}
+
+				// Sealed states aren't stored in the clear
+				if sealed && tc.name != "memory" {
+					err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+						if err != nil || d.IsDir() {
+							return err
+						}
+						b, err := os.ReadFile(path)
+						if err != nil {
+							return err
+						}
+						if bytes.Contains(b, want) || bytes.Contains(b, []byte(base64.StdEncoding.EncodeToString(want))) {
+							return fmt.Errorf("%s stores the state in the clear", path)
+						}
+						return nil
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				// Deleting twice isn't an error
+				for i := 0; i < 2; i++ {
+					if err := store.Delete(ctx, "b"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err := store.Load(ctx, "b"); !errors.Is(err, ErrStateNotFound) {
+					t.Fatalf("expected not found error, got %v", err)
+				}
+
+				// States expire after the TTL
+				now = now.Add(2 * time.Hour)
+				if _, err := store.Load(ctx, "a"); !errors.Is(err, ErrStateNotFound) {
+					t.Fatalf("expected not found error, got %v", err)
+				}
+				ids, err = store.List(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(ids) != 0 {
+					t.Fatalf("unexpected ids %q", ids)
+				}
+
+				// Canceled contexts are honored
+				canceled, cancel := context.WithCancel(ctx)
+				cancel()
+				if err := store.Save(canceled, "c", state); !errors.Is(err, context.Canceled) {
+					t.Fatalf("expected canceled error, got %v", err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package resumetls
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// recordHeaderLen is the length of a TLS record header
+const recordHeaderLen = 5
+
+// RecordSequence returns the number of records received and sent with the
+// current keys, which is what both peers must agree on to continue the
+// connection over a new transport. Complete records that were received but
+// haven't been decrypted yet are counted as received.
+func (s *State) RecordSequence() (in, out uint64) {
+	complete, _ := splitRecords(s.pending.rawInput)
+	in = binary.BigEndian.Uint64(s.inSeq[:]) + uint64(complete)
+	return in, binary.BigEndian.Uint64(s.outSeq[:])
+}
+
+// TrimPartialRecord discards the incomplete record at the end of the received
+// data, which can't be completed once the transport that carried it is gone.
+// It returns the number of bytes discarded.
+func (s *State) TrimPartialRecord() int {
+	_, n := splitRecords(s.pending.rawInput)
+	trimmed := len(s.pending.rawInput) - n
+	s.pending.rawInput = s.pending.rawInput[:n]
+	return trimmed
+}
+
+// splitRecords returns the number of complete records at the start of b and
+// their total length
+func splitRecords(b []byte) (int, int) {
+	var count, n int
+	for len(b)-n >= recordHeaderLen {
+		length := recordHeaderLen + int(binary.BigEndian.Uint16(b[n+3:]))
+		if len(b)-n < length {
+			break
+		}
+		count++
+		n += length
+	}
+	return count, n
+}
+
+// SkipRecords advances the received record sequence number to in, skipping
+// records sent by the peer that were lost with a broken transport and will
+// never be received, so their data must be retransmitted by other means.
+// Sequence numbers never go backwards, so no nonce is used twice. Received
+// data that wasn't read yet precedes the skipped records and must be read
+// before.
+func (s *State) SkipRecords(in uint64) error {
+	if len(s.pending.rawInput) > 0 || len(s.pending.input) > 0 {
+		return errors.New("resumetls: can't skip records with received data not read yet")
+	}
+	if current := binary.BigEndian.Uint64(s.inSeq[:]); in < current {
+		return fmt.Errorf("resumetls: can't skip from record %d back to %d", current, in)
+	}
+	binary.BigEndian.PutUint64(s.inSeq[:], in)
+	return nil
+}
@@ -0,0 +1,59 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestRecordSequence(t *testing.T) {
+	pair := newCertificate(t)
+	c, _ := handshakedConn(t, true, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}, &tls.Config{Certificates: []tls.Certificate{pair}})
+	state := c.State()
+	// The finished message and the echoed message were sent and received
+	start, out := state.RecordSequence()
+	if start != 2 || out != 2 {
+		t.Fatalf("unexpected sequence %d %d", start, out)
+	}
+
+	// Complete records not decrypted yet are counted as received, the
+	// partial record at the end is trimmed
+	record := []byte{23, 3, 3, 0, 2, 0xaa, 0xbb}
+	partial := []byte{23, 3, 3, 0, 8, 0xcc}
+	state.pending.rawInput = append(append(append([]byte{}, record...), record...), partial...)
+	if in, _ := state.RecordSequence(); in != start+2 {
+		t.Fatalf("unexpected received sequence %d", in)
+	}
+	if n := state.TrimPartialRecord(); n != len(partial) {
+		t.Fatalf("unexpected trimmed bytes %d", n)
+	}
+	if n := state.TrimPartialRecord(); n != 0 {
+		t.Fatalf("unexpected trimmed bytes %d", n)
+	}
+	if in, _ := state.RecordSequence(); in != start+2 {
+		t.Fatalf("unexpected received sequence %d", in)
+	}
+}
+
+func TestSkipRecords(t *testing.T) {
+	pair := newCertificate(t)
+	c, _ := handshakedConn(t, true, &tls.Config{InsecureSkipVerify: true}, &tls.Config{Certificates: []tls.Certificate{pair}})
+	state := c.State()
+	start, _ := state.RecordSequence()
+	if err := state.SkipRecords(start + 3); err != nil {
+		t.Fatal(err)
+	}
+	if in, _ := state.RecordSequence(); in != start+3 {
+		t.Fatalf("unexpected received sequence %d", in)
+	}
+
+	// Sequence numbers never go backwards
+	if err := state.SkipRecords(start); err == nil {
+		t.Fatal("expected error skipping backwards")
+	}
+
+	// Records can't be skipped with received data not read yet
+	state.pending.input = []byte("unread")
+	if err := state.SkipRecords(start + 4); err == nil {
+		t.Fatal("expected error skipping with unread data")
+	}
+}
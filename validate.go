@@ -0,0 +1,98 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/igolaizola/resumetls/internal/suite"
+)
+
+var (
+	// ErrStateMismatch is returned when a state can't be resumed using the
+	// provided config
+	ErrStateMismatch = errors.New("resumetls: state doesn't match the config")
+	// ErrStateCorrupt is returned when a state is malformed
+	ErrStateCorrupt = errors.New("resumetls: corrupt state")
+	// ErrRoleMismatch is returned when a client state is resumed as a server
+	// or vice versa
+	ErrRoleMismatch = errors.New("resumetls: state role doesn't match the conn role")
+)
+
+// Is makes StateVersionError match ErrStateCorrupt
+func (e *StateVersionError) Is(target error) bool {
+	return target == ErrStateCorrupt
+}
+
+// Is makes StateFieldError match ErrStateCorrupt
+func (e *StateFieldError) Is(target error) bool {
+	return target == ErrStateCorrupt
+}
+
+// mismatchError returns an error wrapping ErrStateMismatch
+func mismatchError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrStateMismatch, fmt.Sprintf(format, args...))
+}
+
+// corruptError returns an error wrapping ErrStateCorrupt
+func corruptError(err error) error {
+	return fmt.Errorf("%w: %w", ErrStateCorrupt, err)
+}
+
+// checkConfig checks that a state can be resumed using cfg
+func (s *State) checkConfig(cfg *tls.Config, role Role) error {
+	if s.version != 0 {
+		if (cfg.MinVersion != 0 && s.version < cfg.MinVersion) ||
+			(cfg.MaxVersion != 0 && s.version > cfg.MaxVersion) {
+			return mismatchError("%s not enabled", tls.VersionName(s.version))
+		}
+		// TLS 1.3 cipher suites aren't configurable
+		if s.version < tls.VersionTLS13 && cfg.CipherSuites != nil &&
+			!slices.Contains(cfg.CipherSuites, s.cipherSuite) {
+			return mismatchError("cipher suite %s not enabled", tls.CipherSuiteName(s.cipherSuite))
+		}
+	}
+	if role == RoleClient {
+		if name := hostnameInSNI(cfg.ServerName); name != s.serverName {
+			return mismatchError("server name %q, state server name %q", name, s.serverName)
+		}
+	}
+	return nil
+}
+
+// checkTranscript checks that the handshake was recorded by a conn with the
+// same role. Clients record the messages sent by the server, which start with
+// a server hello, and servers record a client hello.
+func (s *State) checkTranscript(role Role) error {
+	typ, err := suite.FirstHandshakeType(s.conn)
+	if err != nil {
+		return corruptError(err)
+	}
+	want := suite.TypeClientHello
+	if role == RoleClient {
+		want = suite.TypeServerHello
+	}
+	if typ != want {
+		return ErrRoleMismatch
+	}
+	return nil
+}
+
+// hostnameInSNI returns the server name sent by a client as crypto/tls does,
+// IP addresses aren't sent
+func hostnameInSNI(name string) string {
+	host := name
+	if len(host) > 0 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+	if i := strings.LastIndex(host, "%"); i > 0 {
+		host = host[:i]
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	return strings.TrimRight(name, ".")
+}
@@ -0,0 +1,102 @@
+package resumetls
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestResumeMismatch(t *testing.T) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newCertificate(t)
+	cliCfg := func() *tls.Config {
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "localhost",
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		}
+	}
+	srvCfg := func(cert tls.Certificate) *tls.Config {
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		client  bool
+		compact bool
+		resume  func(net.Conn, *State) (*Conn, error)
+		want    error
+	}{
+		{"Role", true, false, func(conn net.Conn, s *State) (*Conn, error) {
+			return Server(conn, srvCfg(pair), s)
+		}, ErrRoleMismatch},
+		{"Version", true, false, func(conn net.Conn, s *State) (*Conn, error) {
+			cfg := cliCfg()
+			cfg.MinVersion = tls.VersionTLS13
+			cfg.MaxVersion = tls.VersionTLS13
+			return Client(conn, cfg, s)
+		}, ErrStateMismatch},
+		{"CipherSuite", true, false, func(conn net.Conn, s *State) (*Conn, error) {
+			cfg := cliCfg()
+			cfg.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+			return Client(conn, cfg, s)
+		}, ErrStateMismatch},
+		{"ServerName", true, false, func(conn net.Conn, s *State) (*Conn, error) {
+			cfg := cliCfg()
+			cfg.ServerName = "example.com"
+			return Client(conn, cfg, s)
+		}, ErrStateMismatch},
+		{"Certificate", false, false, func(conn net.Conn, s *State) (*Conn, error) {
+			return Server(conn, srvCfg(other), s)
+		}, ErrStateMismatch},
+		{"CompactCertificate", false, true, func(conn net.Conn, s *State) (*Conn, error) {
+			return Server(conn, srvCfg(other), s)
+		}, ErrStateMismatch},
+		{"CompactServerName", true, true, func(conn net.Conn, s *State) (*Conn, error) {
+			cfg := cliCfg()
+			cfg.ServerName = "example.com"
+			return Client(conn, cfg, s)
+		}, ErrStateMismatch},
+		{"Transcript", true, false, func(conn net.Conn, s *State) (*Conn, error) {
+			s.conn = []byte{1, 2, 3}
+			return Client(conn, cliCfg(), s)
+		}, ErrStateCorrupt},
+		{"Replay", true, false, func(conn net.Conn, s *State) (*Conn, error) {
+			// Flip a byte of the server random
+			s.conn = append([]byte{}, s.conn...)
+			s.conn[15] ^= 0xff
+			return Client(conn, cliCfg(), s)
+		}, ErrStateMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c *Conn
+			var conn net.Conn
+			if tt.client {
+				c, conn = handshakedConn(t, true, cliCfg(), srvCfg(pair))
+			} else {
+				c, conn = handshakedConn(t, false, srvCfg(pair), cliCfg())
+			}
+			state := c.State()
+			if tt.compact {
+				var err error
+				if state, err = c.CompactState(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := tt.resume(conn, state)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package resumetls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/igolaizola/resumetls/internal/suite"
+)
+
+// walMagic prefixes every write-ahead log
+var walMagic = [4]byte{'R', 'T', 'L', 'W'}
+
+// walVersion is the current write-ahead log format version
+const walVersion = 1
+
+// Write-ahead log entry types
+const (
+	// walBase is the binary encoded state the log starts from
+	walBase byte = iota + 1
+	// walOut is the sequence number and traffic secret of the next record
+	// sent
+	walOut
+	// walIn is the sequence number and traffic secret of the next record
+	// received, and the data received and not read yet
+	walIn
+	// walData is the plaintext of a write
+	walData
+	// walWritten marks the last write as completed
+	walWritten
+)
+
+// walEntryHeaderLen is the length of an entry type plus its length prefix,
+// entries are followed by a CRC-32 of the header and the payload
+const walEntryHeaderLen = 1 + 4
+
+// walCompactSize is the log size that triggers replacing the log with a new
+// base state
+const walCompactSize = 4 << 20
+
+// WithWAL makes the conn keep a write-ahead log at path, which RecoverWAL
+// turns into the exact state of the conn after a crash.
+//
+// The sequence number of every record is synced to the log before the record
+// is sent, so a recovered conn never reuses an AEAD nonce, and the plaintext
+// of every write is logged before it is encrypted. That costs an fsync per
+// record, crypto/tls splits large writes in records of up to 16 KiB and the
+// first writes of a conn in smaller ones. A write whose data was sent but not
+// marked as completed in the log returns the log error along with the number
+// of bytes written, and every later write fails. Reads log the sequence
+// number of the records received along with the data received and not read
+// yet, including records not decrypted yet.
+// The log starts with the state of the conn once the handshake is completed,
+// or the state it was resumed from, and it is replaced by a new state when it
+// grows too large. An existing log at path is only replaced at that point.
+// Data received by a read that didn't return before the crash and session
+// tickets received after the log started aren't logged, so the recovered
+// conn fails to read the records following that data.
+func WithWAL(path string) Option {
+	return func(o *options) {
+		o.wal = path
+	}
+}
+
+// wal is the write-ahead log of a conn
+type wal struct {
+	path string
+
+	mu   sync.Mutex
+	conn *tls.Conn
+	f    *os.File
+	size int64
+	// state is the base state with the logged entries applied, nil until
+	// the log is started
+	state *State
+	// pending is the plaintext of the last write while it isn't completed
+	pending []byte
+	// err fails every entry once the log can't be trusted
+	err error
+}
+
+// walConn logs the sequence numbers of the records written through it
+type walConn struct {
+	net.Conn
+	wal *wal
+}
+
+// Write logs the sequence number following the records being written before
+// writing them. crypto/tls writes records with the write half locked, so the
+// sequence number already accounts for them.
+func (c *walConn) Write(b []byte) (int, error) {
+	if err := c.wal.logOut(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// newWAL returns the log kept at path, which isn't written until it is
+// started
+func newWAL(path string) *wal {
+	return &wal{path: path}
+}
+
+// attach sets the tls conn whose sequence numbers are logged
+func (w *wal) attach(conn *tls.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn = conn
+}
+
+// start replaces the log at path with a new log starting from state
+func (w *wal) start(state *State) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.state = state
+	if err := w.rewrite(); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// logOut logs the sequence number and traffic secret of the write half if
+// they changed, the write half must be locked
+func (w *wal) logOut() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state == nil || w.err != nil {
+		return w.err
+	}
+	seq, secret := getSeq(w.conn, "out"), getTrafficSecret(w.conn, "out")
+	if seq == w.state.outSeq && bytes.Equal(secret, w.state.outSecret) {
+		return nil
+	}
+	return w.append(walOut, append(seq[:], secret...), true)
+}
+
+// logIn logs the sequence number and traffic secret of the read half along
+// with the data received and not read yet if they changed
+func (w *wal) logIn(seq [8]byte, secret []byte, pending buffers) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state == nil || w.err != nil {
+		return w.err
+	}
+	s := w.state
+	if seq == s.inSeq && bytes.Equal(secret, s.inSecret) && pending.equal(s.pending) {
+		return nil
+	}
+	payload := append(seq[:], byte(len(secret)))
+	payload = append(payload, secret...)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(pending.rawInput)))
+	payload = append(payload, pending.rawInput...)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(pending.input)))
+	payload = append(payload, pending.input...)
+	return w.append(walIn, append(payload, pending.hand...), true)
+}
+
+// logData logs the plaintext of a write, it is synced along with the first
+// record of the write
+func (w *wal) logData(b []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state == nil || w.err != nil {
+		return w.err
+	}
+	return w.append(walData, b, false)
+}
+
+// logWritten marks the last write as completed
+func (w *wal) logWritten() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state == nil || w.err != nil {
+		return w.err
+	}
+	return w.append(walWritten, nil, false)
+}
+
+// append appends an entry to the log and applies it to the state, the log is
+// replaced by a new base state once it grows too large
+func (w *wal) append(typ byte, payload []byte, sync bool) error {
+	if err := applyWALEntry(w.state, &w.pending, typ, payload); err != nil {
+		w.err = err
+		return err
+	}
+	entry := appendWALEntry(nil, typ, payload)
+	if _, err := w.f.Write(entry); err != nil {
+		w.err = fmt.Errorf("resumetls: couldn't write to wal: %w", err)
+		return w.err
+	}
+	w.size += int64(len(entry))
+	if w.size >= walCompactSize {
+		if err := w.rewrite(); err != nil {
+			w.err = err
+			return err
+		}
+		return nil
+	}
+	if sync {
+		if err := w.f.Sync(); err != nil {
+			w.err = fmt.Errorf("resumetls: couldn't sync wal: %w", err)
+			return w.err
+		}
+	}
+	return nil
+}
+
+// rewrite atomically replaces the log with a log starting from the current
+// state and the pending write
+func (w *wal) rewrite() error {
+	base, err := w.state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	b := append(append([]byte{}, walMagic[:]...), walVersion)
+	b = appendWALEntry(b, walBase, base)
+	if w.pending != nil {
+		b = appendWALEntry(b, walData, w.pending)
+	}
+	if err := writeFileAtomic(w.path, b); err != nil {
+		return fmt.Errorf("resumetls: couldn't start wal: %w", err)
+	}
+	if w.f != nil {
+		_ = w.f.Close()
+	}
+	w.f, err = os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("resumetls: couldn't open wal: %w", err)
+	}
+	w.size = int64(len(b))
+	return nil
+}
+
+// close closes the log, which is kept at path
+func (w *wal) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f != nil {
+		_ = w.f.Close()
+	}
+	if w.err == nil {
+		w.err = net.ErrClosed
+	}
+}
+
+// logProgress logs the progress of both halves of the conn, which may change
+// while reading because of alerts and key updates
+func (c *Conn) logProgress() error {
+	if c.wal == nil {
+		return nil
+	}
+	in := halfMutex(c.Conn, "in")
+	in.Lock()
+	seq, secret := getSeq(c.Conn, "in"), cloneBytes(getTrafficSecret(c.Conn, "in"))
+	pending := getBuffers(c.Conn)
+	in.Unlock()
+	if err := c.wal.logIn(seq, secret, pending); err != nil {
+		return err
+	}
+
+	out := halfMutex(c.Conn, "out")
+	out.Lock()
+	defer out.Unlock()
+	return c.wal.logOut()
+}
+
+// appendWALEntry appends an encoded entry to b
+func appendWALEntry(b []byte, typ byte, payload []byte) []byte {
+	start := len(b)
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	b = append(b, payload...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:]))
+}
+
+// applyWALEntry applies an entry to a state and the pending write
+func applyWALEntry(state *State, pending *[]byte, typ byte, payload []byte) error {
+	switch typ {
+	case walOut, walIn:
+		if len(payload) < 8 {
+			return corruptError(errors.New("truncated wal entry"))
+		}
+		seq := [8]byte(payload[:8])
+		payload = payload[8:]
+		if typ == walOut {
+			state.outSeq = seq
+			return state.setTrafficSecret(payload, false)
+		}
+		if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+			return corruptError(errors.New("truncated wal entry"))
+		}
+		secret := payload[1 : 1+int(payload[0])]
+		payload = payload[1+len(secret):]
+		var pending buffers
+		for _, field := range []*[]byte{&pending.rawInput, &pending.input} {
+			if len(payload) < 4 || uint64(len(payload)-4) < uint64(binary.BigEndian.Uint32(payload)) {
+				return corruptError(errors.New("truncated wal entry"))
+			}
+			n := 4 + int(binary.BigEndian.Uint32(payload))
+			*field = cloneBytes(payload[4:n])
+			payload = payload[n:]
+		}
+		pending.hand = cloneBytes(payload)
+		state.inSeq = seq
+		state.pending = pending
+		return state.setTrafficSecret(secret, true)
+	case walData:
+		*pending = append([]byte{}, payload...)
+	case walWritten:
+		*pending = nil
+	default:
+		return corruptError(fmt.Errorf("unknown wal entry type %d", typ))
+	}
+	return nil
+}
+
+// setTrafficSecret sets the TLS 1.3 traffic secret of a direction after a key
+// update, along with the record keys of compact states
+func (s *State) setTrafficSecret(secret []byte, read bool) error {
+	current := &s.outSecret
+	keys := &s.outKeys
+	if read {
+		current, keys = &s.inSecret, &s.inKeys
+	}
+	if len(secret) == 0 || bytes.Equal(secret, *current) {
+		return nil
+	}
+	*current = cloneBytes(secret)
+	if !s.compact() {
+		return nil
+	}
+	cs, err := suite.Lookup(s.version, s.cipherSuite)
+	if err != nil {
+		return corruptError(err)
+	}
+	*keys = cs.KeysFromTrafficSecret(secret)
+	return nil
+}
+
+// RecoverWAL reads the write-ahead log kept at path by a conn created with
+// WithWAL and returns the state of the conn as of the last logged records,
+// which can be resumed without reusing nonces.
+// It also returns the plaintext of the last write if it didn't complete, the
+// peer may have received any part of it. An incomplete entry at the end of
+// the log, left by a crash while it was written, is ignored, but a damaged
+// entry followed by other entries fails with ErrStateCorrupt.
+func RecoverWAL(path string) (*State, []byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resumetls: couldn't read wal: %w", err)
+	}
+	if len(b) < len(walMagic)+1 || [4]byte(b[:4]) != walMagic {
+		return nil, nil, corruptError(errors.New("bad wal header"))
+	}
+	if v := int(b[4]); v != walVersion {
+		return nil, nil, fmt.Errorf("resumetls: unsupported wal version %d", v)
+	}
+	b = b[len(walMagic)+1:]
+
+	var state *State
+	var pending []byte
+	for len(b) >= walEntryHeaderLen {
+		length := int(binary.BigEndian.Uint32(b[1:]))
+		end := walEntryHeaderLen + length
+		if len(b) < end+4 {
+			// Torn by a crash while it was appended
+			break
+		}
+		if binary.BigEndian.Uint32(b[end:]) != crc32.ChecksumIEEE(b[:end]) {
+			// Only the last entry can be torn, an older sequence number
+			// recovered from a damaged log would reuse nonces
+			if len(b) > end+4 {
+				return nil, nil, corruptError(errors.New("bad wal entry checksum"))
+			}
+			break
+		}
+		typ, payload := b[0], b[walEntryHeaderLen:end]
+		b = b[end+4:]
+		if typ == walBase {
+			state = &State{}
+			if err := state.UnmarshalBinary(payload); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if state == nil {
+			return nil, nil, corruptError(errors.New("wal doesn't start with a state"))
+		}
+		if err := applyWALEntry(state, &pending, typ, payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	if state == nil {
+		return nil, nil, corruptError(errors.New("wal doesn't start with a state"))
+	}
+	return state, pending, nil
+}
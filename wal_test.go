@@ -0,0 +1,150 @@
+package resumetls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWAL(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		for _, compact := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s compact=%v", tls.VersionName(version), compact), func(t *testing.T) {
+				testWAL(t, version, compact)
+			})
+		}
+	}
+}
+
+func testWAL(t *testing.T, version uint16, compact bool) {
+	path := filepath.Join(t.TempDir(), "conn.wal")
+	cliCfg := &tls.Config{InsecureSkipVerify: true, MaxVersion: version}
+	srvCfg := &tls.Config{Certificates: []tls.Certificate{newCertificate(t)}}
+	cli, srv, cConn, _ := resumablePair(t, cliCfg, srvCfg, WithWAL(path))
+	exchange(t, cli, srv, false)
+
+	// The log of a conn resumed from a compact state starts from it
+	if compact {
+		if _, err := cli.Pause(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		state, err := cli.CompactState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.detach()
+		if cli, err = Client(cConn, cliCfg, state, WithWAL(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exchange(t, cli, srv, version == tls.VersionTLS13)
+	exchange(t, cli, srv, version == tls.VersionTLS13)
+
+	// Part of a record is read before the crash, the next record is received
+	// along with it and isn't decrypted yet
+	if _, err := srv.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	recv := make([]byte, 5)
+	if _, err := cli.Read(recv); err != nil {
+		t.Fatal(err)
+	}
+	cli.detach()
+
+	state, pending, err := RecoverWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != nil {
+		t.Fatalf("unexpected pending write %q", pending)
+	}
+	if state.compact() != compact {
+		t.Fatalf("unexpected compact state %v", state.compact())
+	}
+	if len(state.pending.rawInput) == 0 {
+		t.Fatal("received record not logged")
+	}
+	cli2, err := Client(cConn, cliCfg, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{" world", "again"} {
+		recv := make([]byte, 1024)
+		n, err := cli2.Read(recv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(recv[:n]) != want {
+			t.Fatalf("unexpected data %q, expected %q", recv[:n], want)
+		}
+	}
+	exchange(t, cli2, srv, version == tls.VersionTLS13)
+}
+
+func TestWALPendingWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conn.wal")
+	cli, cConn := handshakedConn(t, true, &tls.Config{InsecureSkipVerify: true},
+		&tls.Config{Certificates: []tls.Certificate{newCertificate(t)}}, WithWAL(path))
+	state, _, err := RecoverWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, start := state.RecordSequence()
+
+	// The write fails after its record is logged, so its sequence number is
+	// never used again
+	_ = cConn.Close()
+	if _, err := cli.Write([]byte("lost")); err == nil {
+		t.Fatal("expected write error")
+	}
+	state, pending, err := RecoverWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pending) != "lost" {
+		t.Fatalf("unexpected pending write %q", pending)
+	}
+	if _, out := state.RecordSequence(); out != start+1 {
+		t.Fatalf("unexpected sent sequence %d, expected %d", out, start+1)
+	}
+
+	// An entry torn by a crash is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{walOut, 0, 0, 0, 40, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	recovered, _, err := RecoverWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, out := recovered.RecordSequence(); out != start+1 {
+		t.Fatalf("unexpected sent sequence %d, expected %d", out, start+1)
+	}
+
+	// A damaged entry followed by other entries isn't mistaken for a torn one
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(walMagic)+1+walEntryHeaderLen] ^= 0xff
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := RecoverWAL(path); !errors.Is(err, ErrStateCorrupt) {
+		t.Fatalf("expected corrupt error, got %v", err)
+	}
+}